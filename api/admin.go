@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sammy007/open-ethereum-pool/payouts"
+)
+
+// Background job which halts on critical error until operator resumes it
+type Service interface {
+	Status() payouts.HealthStatus
+	Resume()
+}
+
+// Service able to preview its next run without side effects
+type DryRunner interface {
+	DryRun() (*payouts.PayoutPreview, error)
+}
+
+// Exposes service of a shard on admin API under given kind, e.g. "unlocker" or "payouts"
+func (s *ApiServer) AddService(kind, shardId string, svc Service) {
+	if s.services[kind] == nil {
+		s.services[kind] = make(map[string]Service)
+	}
+	s.services[kind][shardId] = svc
+}
+
+// Admin API must not be reachable from outside, bind it to localhost
+func (s *ApiServer) listenAdmin() {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/status", s.AdminStatus).Methods("GET")
+	r.HandleFunc("/admin/resume", s.AdminResume).Methods("POST")
+	r.HandleFunc("/admin/payouts/dryrun", s.AdminPayoutsDryRun).Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	log.Printf("Starting admin API on %v", s.config.AdminListen)
+	err := http.ListenAndServe(s.config.AdminListen, r)
+	if err != nil {
+		log.Fatalf("Failed to start admin API: %v", err)
+	}
+}
+
+// Halt state and last error of every service by kind and shard
+func (s *ApiServer) AdminStatus(w http.ResponseWriter, r *http.Request) {
+	reply := make(map[string]map[string]payouts.HealthStatus)
+	for kind, shards := range s.services {
+		reply[kind] = make(map[string]payouts.HealthStatus)
+		for shardId, svc := range shards {
+			reply[kind][shardId] = svc.Status()
+		}
+	}
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+// Resumes services matching optional "service" and "shard" query params, all of them if not set
+func (s *ApiServer) AdminResume(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("service")
+	shard := r.URL.Query().Get("shard")
+
+	var resumed []string
+	for k, shards := range s.services {
+		if len(kind) > 0 && k != kind {
+			continue
+		}
+		for shardId, svc := range shards {
+			if len(shard) > 0 && shardId != shard {
+				continue
+			}
+			svc.Resume()
+			resumed = append(resumed, k+" "+shardId)
+		}
+	}
+	if len(resumed) == 0 {
+		writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"error": "No matching services"})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"resumed": resumed})
+}
+
+// Next payout run of every shard or the one in optional "shard" query param, nothing is sent
+func (s *ApiServer) AdminPayoutsDryRun(w http.ResponseWriter, r *http.Request) {
+	shard := r.URL.Query().Get("shard")
+
+	reply := make(map[string]interface{})
+	for shardId, svc := range s.services["payouts"] {
+		if len(shard) > 0 && shardId != shard {
+			continue
+		}
+		runner, ok := svc.(DryRunner)
+		if !ok {
+			continue
+		}
+		preview, err := runner.DryRun()
+		if err != nil {
+			reply[shardId] = map[string]interface{}{"error": err.Error()}
+			continue
+		}
+		reply[shardId] = preview
+	}
+	if len(reply) == 0 {
+		writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"error": "No matching payouts"})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing admin API response: ", err)
+	}
+}
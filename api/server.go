@@ -29,17 +29,23 @@ type ApiConfig struct {
 	Blocks               int64  `json:"blocks"`
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
+	// Status and control of unlocker and payouts, disabled if empty
+	AdminListen string `json:"adminListen"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.StatsStorage
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	// Storage of every shard served by the pool, keyed by shard id
+	shards map[string]storage.StatsStorage
+	// Services exposed on admin API by kind and shard id
+	services map[string]map[string]Service
 }
 
 type Entry struct {
@@ -47,7 +53,7 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.StatsStorage) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
 	return &ApiServer{
@@ -56,9 +62,16 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		shards:              make(map[string]storage.StatsStorage),
+		services:            make(map[string]map[string]Service),
 	}
 }
 
+// Includes summary of the shard into pool stats
+func (s *ApiServer) AddShard(shardId string, backend storage.StatsStorage) {
+	s.shards[shardId] = backend
+}
+
 func (s *ApiServer) Start() {
 	if s.config.PurgeOnly {
 		log.Printf("Starting API in purge-only mode")
@@ -98,6 +111,9 @@ func (s *ApiServer) Start() {
 		}
 	}()
 
+	if len(s.config.AdminListen) > 0 {
+		go s.listenAdmin()
+	}
 	if !s.config.PurgeOnly {
 		s.listen()
 	}
@@ -182,10 +198,49 @@ func (s *ApiServer) collectStats() {
 			return
 		}
 	}
+	stats["pps"], err = s.backend.CollectPPSStats()
+	if err != nil {
+		log.Printf("Failed to fetch PPS stats from backend: %v", err)
+		return
+	}
+	if len(s.shards) > 0 {
+		stats["shards"], stats["hashrateTotal"], err = s.collectShardStats()
+		if err != nil {
+			log.Printf("Failed to fetch shard stats from backend: %v", err)
+			return
+		}
+	}
 	s.stats.Store(stats)
 	log.Printf("Stats collection finished %s", time.Since(start))
 }
 
+func (s *ApiServer) collectShardStats() (map[string]interface{}, int64, error) {
+	shards := make(map[string]interface{})
+	var totalHashrate int64
+	for shardId, backend := range s.shards {
+		stats, err := backend.CollectStats(s.hashrateWindow, 1, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		nodes, err := backend.GetNodeStates()
+		if err != nil {
+			return nil, 0, err
+		}
+		totalHashrate += stats["hashrate"].(int64)
+		shards[shardId] = map[string]interface{}{
+			"nodes":           nodes,
+			"stats":           stats["stats"],
+			"hashrate":        stats["hashrate"],
+			"minersTotal":     stats["minersTotal"],
+			"candidatesTotal": stats["candidatesTotal"],
+			"immatureTotal":   stats["immatureTotal"],
+			"maturedTotal":    stats["maturedTotal"],
+			"tokens":          stats["tokens"],
+		}
+	}
+	return shards, totalHashrate, nil
+}
+
 func (s *ApiServer) GetWorkersIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -236,6 +291,11 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
 		reply["hashrateList"] = stats["hashrateList"]
+		reply["pps"] = stats["pps"]
+		reply["tokens"] = stats["tokens"]
+		reply["roots"] = stats["roots"]
+		reply["shards"] = stats["shards"]
+		reply["hashrateTotal"] = stats["hashrateTotal"]
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -320,8 +380,10 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 		reply["limit"] = int64(len(stats["matured"].([]*storage.BlockData)[lowerBound:upperBound]))
 		reply["numberPages"] = (totalInt + pageSize - 1) / pageSize
 		reply["count"] = totalInt
-		//reply["immature"] = stats["immature"]
-		//reply["immatureTotal"] = stats["immatureTotal"]
+		// Immature blocks carry root block which confirmed them and number of root confirmations
+		reply["immature"] = stats["immature"]
+		reply["immatureTotal"] = stats["immatureTotal"]
+		reply["roots"] = stats["roots"]
 		//reply["candidates"] = stats["candidates"].([]*storage.BlockData)[:50]
 		//reply["candidatesTotal"] = stats["candidatesTotal"]
 		//reply["luck"] = stats["luck"]
@@ -3,43 +3,116 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/yvasiyarov/gorelic"
 
 	"github.com/sammy007/open-ethereum-pool/api"
 	"github.com/sammy007/open-ethereum-pool/payouts"
+	"github.com/sammy007/open-ethereum-pool/policy"
 	"github.com/sammy007/open-ethereum-pool/proxy"
 	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 var cfg proxy.Config
-var backend *storage.RedisClient
+var backend storage.Backend
+
+// Shards served by this process with their configs and storage namespaces
+var shardConfigs []*proxy.Config
+var shardBackends []storage.Backend
+
+// Running services, stopped in this order on shutdown
+var proxies []*proxy.ProxyServer
+var unlockers []*payouts.BlockUnlocker
+var payers []*payouts.PayoutsProcessor
+
+const defaultShutdownTimeout = "30s"
 
 func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	policy := policy.Start(&cfg.Proxy.Policy, backend)
+	for i, c := range shardConfigs {
+		proxies = append(proxies, proxy.NewProxy(c, shardBackends[i], policy))
+	}
+	// HTTP getwork of every shard with its own address, others serve stratum only
+	for i, c := range shardConfigs {
+		if i == 0 || len(c.Proxy.Listen) > 0 {
+			go proxies[i].Start()
+		}
+	}
 }
 
 func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
+	s := api.NewApiServer(&cfg.Api, shardBackends[0])
+	if len(cfg.Shards) > 0 {
+		for i, c := range shardConfigs {
+			s.AddShard(c.Proxy.Stratum.ShardId, shardBackends[i])
+		}
+	}
+	// Services are started for every shard config in the same order
+	for i, u := range unlockers {
+		s.AddService("unlocker", shardConfigs[i].Proxy.Stratum.ShardId, u)
+	}
+	for i, u := range payers {
+		s.AddService("payouts", shardConfigs[i].Proxy.Stratum.ShardId, u)
+	}
 	s.Start()
 }
 
-func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-	u.Start()
+func startBlockUnlocker(c *proxy.Config, backend storage.Backend) {
+	u := payouts.NewBlockUnlocker(&c.BlockUnlocker, backend)
+	unlockers = append(unlockers, u)
+	go u.Start()
+}
+
+func startPayoutsProcessor(c *proxy.Config, backend storage.Backend) {
+	u := payouts.NewPayoutsProcessor(&c.Payouts, backend)
+	payers = append(payers, u)
+	go u.Start()
 }
 
-func startPayoutsProcessor() {
-	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
+func shutdown() {
+	timeout := cfg.ShutdownTimeout
+	if len(timeout) == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := util.MustParseDuration(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for _, s := range proxies {
+			s.Stop(ctx)
+		}
+		for _, u := range unlockers {
+			u.Stop()
+		}
+		for _, u := range payers {
+			u.Stop()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("All services stopped")
+	case <-ctx.Done():
+		log.Printf("Shutdown deadline of %v exceeded, exiting anyway", deadline)
+	}
+	err := backend.Close()
+	if err != nil {
+		log.Printf("Failed to close backend: %v", err)
+	}
 }
 
 func startNewrelic() {
@@ -52,10 +125,10 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
+func readConfig(cfg *proxy.Config, args []string) {
 	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if len(args) > 0 {
+		configFileName = args[0]
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
@@ -71,8 +144,44 @@ func readConfig(cfg *proxy.Config) {
 	}
 }
 
+// Prints next payout run of every shard as JSON, exits with 1 if pool can't afford it
+func payoutsDryRun() {
+	sufficient := true
+	previews := make(map[string]interface{})
+	for i, c := range shardConfigs {
+		migrated, err := shardBackends[i].Migrated()
+		if err != nil {
+			log.Fatalf("Failed to check balance units of shard %v: %v", c.Proxy.Stratum.ShardId, err)
+		}
+		if !migrated {
+			log.Fatalf("Balances of shard %v are not converted to Wei yet, start the pool once before previewing payouts", c.Proxy.Stratum.ShardId)
+		}
+		u, err := payouts.NewPayoutsPreviewer(&c.Payouts, shardBackends[i])
+		if err != nil {
+			log.Fatalf("Invalid payouts config of shard %v: %v", c.Proxy.Stratum.ShardId, err)
+		}
+		preview, err := u.DryRun()
+		if err != nil {
+			log.Fatalf("Failed to preview payouts of shard %v: %v", c.Proxy.Stratum.ShardId, err)
+		}
+		sufficient = sufficient && preview.Sufficient
+		previews[c.Proxy.Stratum.ShardId] = preview
+	}
+	out, _ := json.MarshalIndent(previews, "", "  ")
+	os.Stdout.Write(append(out, '\n'))
+	if !sufficient {
+		os.Exit(1)
+	}
+}
+
 func main() {
-	readConfig(&cfg)
+	// "payouts-dryrun [config.json]" previews payouts instead of running the pool
+	args := os.Args[1:]
+	dryRun := len(args) > 0 && args[0] == "payouts-dryrun"
+	if dryRun {
+		args = args[1:]
+	}
+	readConfig(&cfg, args)
 	rand.Seed(time.Now().UnixNano())
 
 	if cfg.Threads > 0 {
@@ -82,26 +191,62 @@ func main() {
 
 	startNewrelic()
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if cfg.Storage == "memory" {
+		backend = storage.NewMemoryClient(cfg.Coin)
+		log.Println("Using in-memory storage, data will be lost on exit")
+	} else {
+		backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	}
 	pong, err := backend.Check()
 	if err != nil {
 		log.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		log.Printf("Backend check reply: %v", pong)
 	}
+	if n := cfg.BlockUnlocker.ShareLogSize(); n > 0 {
+		backend.SetShareLogSize(n)
+		log.Printf("Logging last %v shares for PPLNS", n)
+	}
+
+	shardConfigs = cfg.ShardConfigs()
+	for _, c := range shardConfigs {
+		if len(cfg.Shards) > 0 {
+			shardBackends = append(shardBackends, backend.Namespace(c.Proxy.Stratum.ShardId))
+			log.Printf("Serving shard %v on %v", c.Proxy.Stratum.ShardId, c.Proxy.Stratum.Listen)
+		} else {
+			shardBackends = append(shardBackends, backend)
+		}
+	}
+	// Dry run must not write anything, it refuses to preview unconverted balances instead
+	if dryRun {
+		payoutsDryRun()
+		return
+	}
+	for _, b := range shardBackends {
+		if err := b.Migrate(); err != nil {
+			log.Fatalf("Failed to convert balances to Wei: %v", err)
+		}
+	}
 
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		startProxy()
+	}
+	for i, c := range shardConfigs {
+		if cfg.BlockUnlocker.Enabled {
+			startBlockUnlocker(c, shardBackends[i])
+		}
+		if cfg.Payouts.Enabled {
+			startPayoutsProcessor(c, shardBackends[i])
+		}
 	}
+	// Admin API needs unlockers and payers registered
 	if cfg.Api.Enabled {
 		go startApi()
 	}
-	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
-	}
-	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
-	}
-	quit := make(chan bool)
-	<-quit
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %v, shutting down", sig)
+	shutdown()
 }
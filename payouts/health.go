@@ -0,0 +1,145 @@
+package payouts
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// First retry after transient error, doubled on every next failure up to job interval
+const retryBaseDelay = 10 * time.Second
+
+// Wraps errors which are expected to go away on retry, like node being behind
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func transient(err error) error {
+	return &transientError{err}
+}
+
+// Node or backend being unreachable or timing out is transient, everything else means
+// inconsistent accounting or node state and needs operator attention
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *transientError:
+		return true
+	case net.Error:
+		return true
+	case *json.SyntaxError:
+		// Proxy in front of node replied with error page
+		return true
+	default:
+		return e == io.EOF || e == io.ErrUnexpectedEOF
+	}
+}
+
+type HealthStatus struct {
+	Halted      bool   `json:"halted"`
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt int64  `json:"lastErrorAt,omitempty"`
+	Failures    int    `json:"failures"`
+	RetryIn     string `json:"retryIn,omitempty"`
+}
+
+// Tracks failures of periodic job. Transient errors skip the rest of iteration and make it retry sooner,
+// critical ones halt the job until operator resumes it.
+type health struct {
+	sync.Mutex
+	name       string
+	halted     bool
+	lastFail   error
+	lastFailAt int64
+	failures   int
+	runFailed  bool
+	retryIn    time.Duration
+}
+
+func (h *health) fail(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastFail = err
+	h.lastFailAt = util.MakeTimestamp()
+	h.runFailed = true
+	if isTransient(err) {
+		h.failures++
+		return
+	}
+	if !h.halted {
+		log.Printf("%s halted due to critical error: %v", h.name, err)
+	}
+	h.halted = true
+}
+
+// Whether current iteration must stop
+func (h *health) suspended() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.halted || h.runFailed
+}
+
+func (h *health) isHalted() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.halted
+}
+
+func (h *health) begin() {
+	h.Lock()
+	defer h.Unlock()
+	h.runFailed = false
+}
+
+// Delay before next iteration, exponential backoff after transient failure
+func (h *health) end(interval time.Duration) time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	h.retryIn = 0
+	if h.halted {
+		return interval
+	}
+	if !h.runFailed {
+		h.failures = 0
+		return interval
+	}
+	delay := retryBaseDelay
+	for i := 1; i < h.failures && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		delay = interval
+	}
+	h.retryIn = delay
+	log.Printf("%s failed %v times in a row, retrying in %v: %v", h.name, h.failures, delay, h.lastFail)
+	return delay
+}
+
+func (h *health) resume() {
+	h.Lock()
+	defer h.Unlock()
+	h.halted = false
+	h.failures = 0
+	log.Printf("%s resumed by operator", h.name)
+}
+
+func (h *health) status() HealthStatus {
+	h.Lock()
+	defer h.Unlock()
+	s := HealthStatus{Halted: h.halted, LastErrorAt: h.lastFailAt, Failures: h.failures}
+	if h.lastFail != nil {
+		s.LastError = h.lastFail.Error()
+	}
+	if h.retryIn > 0 {
+		s.RetryIn = h.retryIn.String()
+	}
+	return s
+}
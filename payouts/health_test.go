@@ -0,0 +1,61 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	if !isTransient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}) {
+		t.Error("Network error must be transient")
+	}
+	if !isTransient(transient(fmt.Errorf("wrong node height"))) {
+		t.Error("Wrapped error must be transient")
+	}
+	if isTransient(errors.New("Not enough balance for payout run")) {
+		t.Error("Unknown error must be critical")
+	}
+}
+
+func TestHealthBackoff(t *testing.T) {
+	h := &health{name: "test"}
+	intv := 10 * time.Minute
+
+	for i, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		h.begin()
+		h.fail(transient(errors.New("timeout")))
+		if !h.suspended() {
+			t.Error("Iteration must stop after failure")
+		}
+		if delay := h.end(intv); delay != expected {
+			t.Errorf("Invalid delay after %v failures: %v", i+1, delay)
+		}
+	}
+
+	h.begin()
+	if h.suspended() {
+		t.Error("Transient failure must not suspend next iteration")
+	}
+	if delay := h.end(intv); delay != intv || h.status().Failures != 0 {
+		t.Errorf("Successful iteration must reset backoff, got %v", delay)
+	}
+
+	h.begin()
+	h.fail(errors.New("inconsistent balance"))
+	h.end(intv)
+	h.begin()
+	if !h.isHalted() || !h.suspended() {
+		t.Error("Critical error must halt")
+	}
+	h.resume()
+	h.begin()
+	if h.suspended() {
+		t.Error("Resumed job must run")
+	}
+	if h.status().LastError != "inconsistent balance" {
+		t.Errorf("Last error must be kept, got %v", h.status())
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"log"
 	"math/big"
 	"os"
+	"sort"
 	"strconv"
-	"time"
-	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 
@@ -31,8 +32,26 @@ type PayoutsConfig struct {
 	AutoGas      bool   `json:"autoGas"`
 	// In Shannon
 	Threshold	int64 `json:"threshold"`
+	// Per token thresholds in Shannon for tokens other than QKC, tokens without threshold are not paid
+	TokenThresholds map[string]int64 `json:"tokenThresholds"`
 	BgSave		bool  `json:"bgsave"`
 	ShardId		string  `json:"shardId"`
+
+	// Transaction signing, either encrypted keystore with password file or plain hex key file
+	KeystoreFile     string `json:"keystoreFile"`
+	PasswordFile     string `json:"passwordFile"`
+	KeyFile          string `json:"keyFile"`
+	NetworkId        string `json:"networkId"`
+	FromFullShardKey string `json:"fromFullShardKey"`
+	ToFullShardKey   string `json:"toFullShardKey"`
+	GasToken         string `json:"gasToken"`
+
+	// Payout tx not mined within this time is replaced with higher gas price, "10m" by default
+	TxTimeout string `json:"txTimeout"`
+	// Gas price increase of replacement tx in percent, 10 by default
+	GasPriceBump int64 `json:"gasPriceBump"`
+	// Replacement never exceeds this gas price, tx is rebroadcast as is once it's reached
+	MaxGasPrice string `json:"maxGasPrice"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -47,22 +66,49 @@ func (self PayoutsConfig) GasPriceHex() string {
 
 type PayoutsProcessor struct {
 	config   *PayoutsConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
 	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	signer   *Signer
+	health   *health
+	txTimeout time.Duration
+	// Guards payout plan between sender and confirmations tracker
+	planMu  sync.Mutex
+	stopped bool
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend storage.Backend) *PayoutsProcessor {
+	u, err := NewPayoutsPreviewer(cfg, backend)
+	if err != nil {
+		log.Fatalf("Invalid payouts config: %v", err)
+	}
+	signer, err := NewSigner(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load payouts signer: %v", err)
+	}
+	u.signer = signer
+	log.Printf("Payouts will be signed by %s", signer.Address())
 	return u
 }
 
-func (u *PayoutsProcessor) Start() {
-	log.Println("Starting payouts")
+// Processor without signing key, it can only preview payouts with DryRun
+func NewPayoutsPreviewer(cfg *PayoutsConfig, backend storage.Backend) (*PayoutsProcessor, error) {
+	// Pool balances are queried on this shard
+	if _, err := util.FullShardKey(cfg.ShardId); err != nil {
+		return nil, fmt.Errorf("payouts shardId: %v", err)
+	}
+	u := &PayoutsProcessor{config: cfg, backend: backend, health: &health{name: "Payouts " + cfg.ShardId}}
+	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
 
+	txTimeout := cfg.TxTimeout
+	if len(txTimeout) == 0 {
+		txTimeout = "10m"
+	}
+	u.txTimeout = util.MustParseDuration(txTimeout)
+	return u, nil
+}
 
+func (u *PayoutsProcessor) Start() {
+	log.Println("Starting payouts")
 
 	if u.mustResolvePayout() {
 		log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
@@ -75,174 +121,328 @@ func (u *PayoutsProcessor) Start() {
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
-	payments := u.backend.GetPendingPayments()
-	if len(payments) > 0 {
-		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
-			formatPendingPayments(payments))
-		return
-	}
-
-	locked, err := u.backend.IsPayoutsLocked()
+	plan, err := u.backend.GetPayoutPlan()
 	if err != nil {
-		log.Println("Unable to start payouts:", err)
+		log.Println("Unable to start payouts, failed to get payout plan:", err)
 		return
 	}
-	if locked {
-		log.Println("Unable to start payouts because they are locked")
-		return
+
+	if plan != nil {
+		log.Printf("Resuming unfinished payout plan %s with %v payments", plan.Id, len(plan.Payments))
+	} else {
+		payments := u.backend.GetPendingPayments()
+		if len(payments) > 0 {
+			log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
+				formatPendingPayments(payments))
+			return
+		}
+
+		locked, err := u.backend.IsPayoutsLocked()
+		if err != nil {
+			log.Println("Unable to start payouts:", err)
+			return
+		}
+		if locked {
+			log.Println("Unable to start payouts because they are locked")
+			return
+		}
 	}
 
 	// Immediately process payouts after start
-	u.process()
-	timer.Reset(intv)
+	timer.Reset(u.process(intv))
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.process()
-				timer.Reset(intv)
+				timer.Reset(u.process(intv))
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(txCheckInterval)
+		for {
+			select {
+			case <-ticker.C:
+				u.checkPlan()
 			}
 		}
 	}()
 }
 
-func (u *PayoutsProcessor) process() {
-	if u.halt {
-		log.Println("Payments suspended due to last critical error:", u.lastFail)
+// Waits for payments being sent or checked and disables further iterations,
+// unfinished plan is resumed on the next start
+func (u *PayoutsProcessor) Stop() {
+	u.planMu.Lock()
+	defer u.planMu.Unlock()
+	u.stopped = true
+	log.Println("Payouts stopped")
+}
+
+// Returns delay before next run, shorter one if run failed with transient error
+func (u *PayoutsProcessor) process(intv time.Duration) time.Duration {
+	u.planMu.Lock()
+	defer u.planMu.Unlock()
+	if u.stopped {
+		return intv
+	}
+
+	if u.health.isHalted() {
+		log.Println("Payments suspended due to last critical error:", u.health.status().LastError)
+		return intv
+	}
+	u.health.begin()
+	u.runPlan()
+	return u.health.end(intv)
+}
+
+func (u *PayoutsProcessor) Status() HealthStatus {
+	return u.health.status()
+}
+
+// Clears halt after critical error and processes payouts immediately
+func (u *PayoutsProcessor) Resume() {
+	u.health.resume()
+	go u.process(util.MustParseDuration(u.config.Interval))
+}
+
+func (u *PayoutsProcessor) runPlan() {
+	plan, err := u.backend.GetPayoutPlan()
+	if err != nil {
+		log.Println("Error while retrieving payout plan from backend:", err)
+		u.health.fail(err)
 		return
 	}
-	mustPay := 0
-	minersPaid := 0
-	totalAmount := big.NewInt(0)
-	payees, err := u.backend.GetPayees()
+	if plan == nil {
+		plan = u.createPlan()
+		if plan == nil {
+			return
+		}
+	}
+	u.sendPlan(plan)
+}
+
+// Debits all payees above threshold at once and assigns sequential nonces to their payments
+func (u *PayoutsProcessor) createPlan() *storage.PayoutPlan {
+	payments, totals, err := u.collectPayments()
 	if err != nil {
 		log.Println("Error while retrieving payees from backend:", err)
-		return
+		u.health.fail(err)
+		return nil
+	}
+	plan := &storage.PayoutPlan{Id: strconv.FormatInt(util.MakeTimestamp(), 10), Payments: payments}
+
+	if len(plan.Payments) == 0 {
+		log.Println("No payees that have reached payout threshold")
+		return nil
+	}
+
+	// Require unlocked account
+	if !u.isUnlockedAccount() {
+		return nil
+	}
+
+	// Check if we have enough funds of every token for the whole run
+	poolBalances, err := u.poolBalances()
+	if err != nil {
+		u.health.fail(err)
+		return nil
+	}
+	for token, totalAmount := range totals {
+		poolBalance := poolBalances[token]
+		if poolBalance == nil {
+			poolBalance = big.NewInt(0)
+		}
+		if poolBalance.Cmp(totalAmount) < 0 {
+			err := fmt.Errorf("Not enough %s balance for payout run, need %s Wei, pool has %s Wei",
+				token, totalAmount.String(), poolBalance.String())
+			u.health.fail(err)
+			return nil
+		}
+	}
+
+	nonce, err := u.rpc.GetTransactionCount(u.signer.Address())
+	if err != nil {
+		log.Println("Failed to get nonce for payout plan:", err)
+		u.health.fail(err)
+		return nil
+	}
+	for i, p := range plan.Payments {
+		p.Nonce = nonce + uint64(i)
+	}
+
+	// Lock payouts and debit balances for the whole plan
+	err = u.backend.CreatePayoutPlan(plan)
+	if err != nil {
+		log.Printf("Failed to create payout plan %s: %v", plan.Id, err)
+		u.health.fail(err)
+		return nil
+	}
+	log.Printf("Created payout plan %s, %v payments, total %s", plan.Id, len(plan.Payments), formatTotals(totals))
+	return plan
+}
+
+// Payments of every payee and token above threshold with totals by token
+func (u *PayoutsProcessor) collectPayments() ([]*storage.PlannedPayment, map[string]*big.Int, error) {
+	payees, err := u.backend.GetPayees()
+	if err != nil {
+		return nil, nil, err
 	}
 
+	var payments []*storage.PlannedPayment
+	totals := make(map[string]*big.Int)
 	for _, login := range payees {
-		fmt.Println("login payees is: %v", login)
-		amount, _ := u.backend.GetBalance(login)
-		fmt.Println("amount is: %v", amount)
-		amountInShannon := big.NewInt(amount)
+		for _, token := range u.tokens() {
+			amount, _ := u.backend.GetBalance(login, token)
+			if !u.reachedThreshold(token, amount) {
+				continue
+			}
+			payments = append(payments, &storage.PlannedPayment{Address: login, Token: token, Amount: amount, State: storage.PaymentNew})
+			if totals[token] == nil {
+				totals[token] = big.NewInt(0)
+			}
+			totals[token].Add(totals[token], amount)
+		}
+	}
+	return payments, totals, nil
+}
 
-		// Shannon^2 = Wei
-		amountInWei := new(big.Int).Mul(amountInShannon, util.Shannon)
+// Sends every payment of a plan which was not sent yet, confirmations are tracked by checkPlan
+func (u *PayoutsProcessor) sendPlan(plan *storage.PayoutPlan) {
+	nonce, err := u.rpc.GetTransactionCount(u.signer.Address())
+	if err != nil {
+		log.Println("Failed to get nonce for payout plan:", err)
+		u.health.fail(err)
+		return
+	}
 
-		if !u.reachedThreshold(amountInShannon) {
+	sent := 0
+	for _, p := range plan.Payments {
+		if p.State != storage.PaymentNew {
 			continue
 		}
-		mustPay++
 
-		// Require active peers before processing
-		//if !u.checkPeers() {
-		//	break
-		//}
-		// Require unlocked account
-		if !u.isUnlockedAccount() {
-			break
+		// Nonce is already used, we may have crashed before tx id was saved or another tx took it
+		if p.Nonce < nonce {
+			log.Printf("Nonce %v of payment to %s is already used by unknown tx, leaving it unresolved", p.Nonce, p.Address)
+			p.State = storage.PaymentUnresolved
+			err = u.backend.UpdatePlannedPayment(plan.Id, p)
+			if err != nil {
+				log.Printf("Failed to update payment of plan %s for %s: %v", plan.Id, p.Address, err)
+				u.health.fail(err)
+				break
+			}
+			continue
 		}
 
-		// Check if we have enough funds
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
+		// Send transaction to pay
+		gasPrice := util.String2Big(u.config.GasPrice)
+		txHash, err := u.sendPayment(p, gasPrice)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-		if poolBalance.Cmp(amountInWei) < 0 {
-			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
-				amountInWei.String(), poolBalance.String())
-			u.halt = true
-			u.lastFail = err
+			log.Printf("Failed to send payment to %s, %v Wei of %s, nonce %v: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
+				p.Address, p.Amount, p.Token, p.Nonce, err, p.Address)
+			u.health.fail(err)
 			break
 		}
 
-		// Lock payments for current payout
-		err = u.backend.LockPayouts(login, amount)
+		// Persist transaction hash
+		p.TxHash = txHash
+		p.State = storage.PaymentSent
+		p.SentAt = time.Now().Unix()
+		p.GasPrice = gasPrice
+		err = u.backend.UpdatePlannedPayment(plan.Id, p)
 		if err != nil {
-			log.Printf("Failed to lock payment for %s: %v", login, err)
-			u.halt = true
-			u.lastFail = err
+			log.Printf("Failed to log payment data for %s, %v Wei of %s, tx: %s: %v", p.Address, p.Amount, p.Token, txHash, err)
+			u.health.fail(err)
 			break
 		}
-		log.Printf("Locked payment for %s, %v Shannon", login, amount)
+		sent++
+		log.Printf("Sent %v Wei of %s to %v, nonce %v, TxHash: %v", p.Amount, p.Token, p.Address, p.Nonce, txHash)
+	}
 
-		// Debit miner's balance and update stats
-		err = u.backend.UpdateBalance(login, amount)
-		if err != nil {
-			log.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
-			break
+	if sent > 0 {
+		log.Printf("Sent %v payments of plan %s", sent, plan.Id)
+	}
+	u.checkUnresolved(plan)
+}
+
+// Plan with unresolved payments is kept locked until operator finds out if they were paid
+func (u *PayoutsProcessor) checkUnresolved(plan *storage.PayoutPlan) {
+	var logins []string
+	for _, p := range plan.Payments {
+		if p.State == storage.PaymentUnresolved {
+			logins = append(logins, p.Address)
 		}
+	}
+	if len(logins) > 0 {
+		u.health.fail(fmt.Errorf("Payout plan %s has unresolved payments to %s. Check outgoing tx for them in block explorer and docs/PAYOUTS.md",
+			plan.Id, strings.Join(logins, ", ")))
+	}
+}
 
-		//value := hexutil.EncodeBig(amountInWei)
-		// Send transactions to pay
+// Checks receipts of sent payments and finishes plan once all of them are settled
+func (u *PayoutsProcessor) checkPlan() {
+	u.planMu.Lock()
+	defer u.planMu.Unlock()
+	if u.stopped {
+		return
+	}
 
-		err = os.Setenv("KEY", "...")
-		if err != nil {
-			log.Printf("err %v", err)
-			u.halt = true
-			u.lastFail = err
-			break
+	plan, err := u.backend.GetPayoutPlan()
+	if err != nil {
+		log.Println("Error while retrieving payout plan from backend:", err)
+		return
+	}
+	if plan == nil {
+		return
+	}
+
+	// Nonce is taken before receipts, so payment mined in between is never taken for dropped one
+	var nonce uint64
+	nonceKnown := false
+
+	for _, p := range plan.Payments {
+		if p.State != storage.PaymentSent && p.State != storage.PaymentPending {
+			continue
 		}
-		fmt.Println("shardId is: %v", u.config.ShardId)
-		stringCommand := "source ~/virtualenv/qc/bin/activate; python3 ~/mainnet-utils/pysrc/batch_send_tx.py --address " + login + " --shardId " + u.config.ShardId + " --value " + amountInShannon.String() + "; deactivate"
-		cmd := exec.Command("bash", "-c", stringCommand)
-		//cmd := exec.Command("bash", "-c", "source ~/virtualenv/qc/bin/activate; python3 ~/mainnet-utils/pysrc/batch_send_tx.py --address 0x248Dc97675f46Cb2AeCa53006F647ED94eF5B502 --value 1; deactivate")
-		out_txHash, _ := cmd.CombinedOutput()
-		txHash := strings.TrimSpace(string(out_txHash))
-		fmt.Println("----------------txHash is : %v", txHash)
-		//txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
-		if txHash == "0x000000000000000000000000000000000000000000000000000000000000000000000000" {
-			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-				login, amount, err, login)
-			u.halt = true
-			u.lastFail = err
-			break
+		if !nonceKnown {
+			nonce, err = u.rpc.GetTransactionCount(u.signer.Address())
+			if err != nil {
+				log.Println("Failed to get nonce:", err)
+				return
+			}
+			nonceKnown = true
 		}
-
-		// Log transaction hash
-		err = u.backend.WritePayment(login, txHash, amount)
+		err = u.checkPayment(plan.Id, p, nonce)
 		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-			u.halt = true
-			u.lastFail = err
-			break
+			log.Printf("Failed to update payment of plan %s for %s, %v Wei of %s: %v", plan.Id, p.Address, p.Amount, p.Token, err)
+			return
 		}
+	}
 
-		minersPaid++
-		totalAmount.Add(totalAmount, big.NewInt(amount))
-		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
+	if !plan.Done() {
+		return
+	}
 
-		// Wait for TX confirmation before further payouts
-		for {
-			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
-			if err != nil {
-				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-				continue
-			}
-			// Tx has been mined
-			if receipt != nil && receipt.Confirmed() {
-				if receipt.Successful() {
-					log.Printf("Payout tx successful for %s: %s", login, txHash)
-				} else {
-					log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-				}
-				break
+	minersPaid := 0
+	totals := make(map[string]*big.Int)
+	for _, p := range plan.Payments {
+		if p.State == storage.PaymentConfirmed {
+			minersPaid++
+			if totals[p.Token] == nil {
+				totals[p.Token] = big.NewInt(0)
 			}
+			totals[p.Token].Add(totals[p.Token], p.Amount)
 		}
 	}
 
-	if mustPay > 0 {
-		log.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
-	} else {
-		log.Println("No payees that have reached payout threshold")
+	err = u.backend.FinishPayoutPlan(plan.Id)
+	if err != nil {
+		log.Printf("Failed to finish payout plan %s: %v", plan.Id, err)
+		return
 	}
+	log.Printf("Finished payout plan %s, paid total %s in %v of %v payments", plan.Id, formatTotals(totals), minersPaid, len(plan.Payments))
 
 	// Save redis state to disk
 	if minersPaid > 0 && u.config.BgSave {
@@ -250,16 +450,177 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
-func (self PayoutsProcessor) isUnlockedAccount() bool {
-	//_, err := self.rpc.Sign(self.config.Address, "0x0")
-	//if err != nil {
-	//	log.Println("Unable to process payouts:", err)
-	//	return false
-	//}
+// Settles payment by receipt of any of its txs, credits it back if it failed or was dropped,
+// replaces or rebroadcasts it if it's stuck
+func (u *PayoutsProcessor) checkPayment(planId string, p *storage.PlannedPayment, nonce uint64) error {
+	// Tx id is unknown, nonce being used by any tx doesn't prove payment
+	if len(p.TxHash) == 0 {
+		if nonce <= p.Nonce {
+			return nil
+		}
+		log.Printf("Nonce %v of payment to %s is used by unknown tx, leaving it unresolved", p.Nonce, p.Address)
+		p.State = storage.PaymentUnresolved
+		return u.backend.UpdatePlannedPayment(planId, p)
+	}
+
+	receipt, err := u.findReceipt(p)
+	if err != nil {
+		log.Printf("Failed to get tx receipt for %v: %v", p.TxHash, err)
+		return nil
+	}
+	if receipt != nil {
+		if !receipt.Successful() {
+			log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx. Crediting back %v Wei of %s",
+				p.Address, p.TxHash, p.Amount, p.Token)
+			p.State = storage.PaymentFailed
+			return u.backend.FailPlannedPayment(planId, p)
+		}
+		p.State = storage.PaymentConfirmed
+		err = u.backend.WritePlannedPayment(planId, p)
+		if err == nil {
+			log.Printf("Payout tx confirmed for %s: %s", p.Address, p.TxHash)
+		}
+		return err
+	}
+
+	// Resend may have failed ambiguously, our tx can be mined under unknown id
+	if u.health.isHalted() {
+		return nil
+	}
+
+	// None of our txs was mined, but nonce is used by another one
+	if nonce > p.Nonce {
+		log.Printf("Payout tx %s to %s was dropped, nonce %v is used by another tx. Crediting back %v Wei of %s",
+			p.TxHash, p.Address, p.Nonce, p.Amount, p.Token)
+		p.State = storage.PaymentDropped
+		return u.backend.FailPlannedPayment(planId, p)
+	}
+
+	if p.State == storage.PaymentSent {
+		tx, err := u.rpc.GetTransaction(p.TxHash)
+		if err != nil {
+			log.Printf("Failed to get payout tx %v: %v", p.TxHash, err)
+		} else if tx != nil {
+			p.State = storage.PaymentPending
+			err = u.backend.UpdatePlannedPayment(planId, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if time.Since(time.Unix(p.SentAt, 0)) < u.txTimeout {
+		return nil
+	}
+	return u.resendPayment(planId, p)
+}
+
+// Receipt of mined tx of payment, TxHash is set to mined one if it was replaced
+func (u *PayoutsProcessor) findReceipt(p *storage.PlannedPayment) (*rpc.TxReceipt, error) {
+	for _, txHash := range p.TxHashes() {
+		receipt, err := u.rpc.GetTxReceipt(txHash)
+		if err != nil {
+			return nil, err
+		}
+		// Tx has not been mined yet
+		if receipt == nil || !receipt.Confirmed() {
+			continue
+		}
+		if txHash != p.TxHash {
+			log.Printf("Replaced payout tx %s to %s was mined instead of %s", txHash, p.Address, p.TxHash)
+			p.TxHash = txHash
+		}
+		return receipt, nil
+	}
+	return nil, nil
+}
+
+// Replaces stuck tx with one having the same nonce and higher gas price,
+// rebroadcasts it as is once gas price can't grow anymore
+func (u *PayoutsProcessor) resendPayment(planId string, p *storage.PlannedPayment) error {
+	gasPrice := u.bumpGasPrice(p.GasPrice)
+	txHash, err := u.sendPayment(p, gasPrice)
+	// Retry after another timeout, not on every check
+	p.SentAt = time.Now().Unix()
+	if err != nil {
+		log.Printf("Failed to resend payment to %s, %v Wei of %s, nonce %v: %v", p.Address, p.Amount, p.Token, p.Nonce, err)
+		if isTransient(err) {
+			// Node may have accepted tx we don't know id of, it can't be credited back if dropped
+			u.health.fail(fmt.Errorf("Can't resend payment to %s, nonce %v: %v. Check outgoing tx for %s in block explorer",
+				p.Address, p.Nonce, err, p.Address))
+		}
+		return u.backend.UpdatePlannedPayment(planId, p)
+	}
+
+	if txHash != p.TxHash {
+		p.Replaced = append(p.Replaced, p.TxHash)
+		p.TxHash = txHash
+	}
+	p.GasPrice = gasPrice
+	p.State = storage.PaymentSent
+	log.Printf("Resent payment to %s, nonce %v, gas price %v, TxHash: %v", p.Address, p.Nonce, gasPrice, txHash)
+	return u.backend.UpdatePlannedPayment(planId, p)
+}
+
+// Gas price of replacement tx, never above configured maximum
+func (u *PayoutsProcessor) bumpGasPrice(gasPrice *big.Int) *big.Int {
+	if gasPrice == nil {
+		gasPrice = util.String2Big(u.config.GasPrice)
+	}
+	bump := u.config.GasPriceBump
+	if bump <= 0 {
+		bump = 10
+	}
+	bumped := new(big.Int).Mul(gasPrice, big.NewInt(100+bump))
+	bumped.Div(bumped, big.NewInt(100))
+	if len(u.config.MaxGasPrice) > 0 {
+		maxGasPrice := util.String2Big(u.config.MaxGasPrice)
+		if bumped.Cmp(maxGasPrice) > 0 {
+			bumped = maxGasPrice
+		}
+	}
+	if bumped.Cmp(gasPrice) < 0 {
+		return gasPrice
+	}
+	return bumped
+}
+
+// Signs payment locally and submits it to the node, returns QuarkChain tx id
+func (u *PayoutsProcessor) sendPayment(p *storage.PlannedPayment, gasPrice *big.Int) (string, error) {
+	gas := util.String2Big(u.config.Gas)
+	tx, err := u.signer.NewTransaction(p.Nonce, p.Address, p.Token, p.Amount, gas, gasPrice)
+	if err != nil {
+		return "", err
+	}
+	err = u.signer.Sign(tx)
+	if err != nil {
+		return "", fmt.Errorf("Can't sign transaction: %v", err)
+	}
+	rawTx, err := tx.RawHex()
+	if err != nil {
+		return "", err
+	}
+	return u.rpc.SendRawTransaction(rawTx)
+}
+
+// Balances of pool account on payouts shard, configured address may already carry full shard key
+func (u *PayoutsProcessor) poolBalances() (map[string]*big.Int, error) {
+	account := u.config.Address
+	if len(account) > 42 {
+		account = account[:42]
+	}
+	return u.rpc.GetBalances(account, u.config.ShardId)
+}
+
+func (self *PayoutsProcessor) isUnlockedAccount() bool {
+	if self.signer == nil {
+		log.Println("Unable to process payouts: signing key is not loaded")
+		return false
+	}
 	return true
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
+func (self *PayoutsProcessor) checkPeers() bool {
 	n, err := self.rpc.GetPeerCount()
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
@@ -272,19 +633,50 @@ func (self PayoutsProcessor) checkPeers() bool {
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-	return big.NewInt(self.config.Threshold).Cmp(amount) < 0
+// Default token is always paid, others only if they have a threshold configured
+func (self *PayoutsProcessor) tokens() []string {
+	tokens := []string{util.DefaultToken}
+	for token := range self.config.TokenThresholds {
+		token = strings.ToUpper(token)
+		if token != util.DefaultToken {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens[1:])
+	return tokens
+}
+
+// Threshold is configured in Shannon, balances are in Wei
+func (self *PayoutsProcessor) reachedThreshold(token string, amount *big.Int) bool {
+	threshold := self.config.Threshold
+	if token != util.DefaultToken {
+		for t, v := range self.config.TokenThresholds {
+			if strings.ToUpper(t) == token {
+				threshold = v
+			}
+		}
+	}
+	return new(big.Int).Mul(big.NewInt(threshold), util.Shannon).Cmp(amount) < 0
 }
 
 func formatPendingPayments(list []*storage.PendingPayment) string {
 	var s string
 	for _, v := range list {
-		s += fmt.Sprintf("\tAddress: %s, Amount: %v Shannon, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
+		s += fmt.Sprintf("\tAddress: %s, Amount: %v Wei of %s, %v\n", v.Address, v.Amount, v.Token, time.Unix(v.Timestamp, 0))
 	}
 	return s
 }
 
-func (self PayoutsProcessor) bgSave() {
+func formatTotals(totals map[string]*big.Int) string {
+	var parts []string
+	for token, amount := range totals {
+		parts = append(parts, fmt.Sprintf("%v Wei of %s", amount, token))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func (self *PayoutsProcessor) bgSave() {
 	result, err := self.backend.BgSave()
 	if err != nil {
 		log.Println("Failed to perform BGSAVE on backend:", err)
@@ -293,19 +685,29 @@ func (self PayoutsProcessor) bgSave() {
 	log.Println("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
+func (self *PayoutsProcessor) resolvePayouts() {
+	plan, err := self.backend.GetPayoutPlan()
+	if err != nil {
+		log.Println("Failed to get payout plan:", err)
+		return
+	}
+	if plan != nil {
+		self.resolvePlan(plan)
+		return
+	}
+
 	payments := self.backend.GetPendingPayments()
 
 	if len(payments) > 0 {
 		log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
 
 		for _, v := range payments {
-			err := self.backend.RollbackBalance(v.Address, v.Amount)
+			err := self.backend.RollbackBalance(v.Address, v.Token, v.Amount)
 			if err != nil {
-				log.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
+				log.Printf("Failed to credit %v Wei of %s back to %s, error is: %v", v.Amount, v.Token, v.Address, err)
 				return
 			}
-			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
+			log.Printf("Credited %v Wei of %s back to %s", v.Amount, v.Token, v.Address)
 		}
 		err := self.backend.UnlockPayouts()
 		if err != nil {
@@ -322,7 +724,59 @@ func (self PayoutsProcessor) resolvePayouts() {
 	log.Println("Payouts unlocked")
 }
 
-func (self PayoutsProcessor) mustResolvePayout() bool {
+// Credits back payments of a plan which were never sent or left unresolved by operator,
+// sent ones are left to confirmations tracker
+func (self *PayoutsProcessor) resolvePlan(plan *storage.PayoutPlan) {
+	nonce, err := self.rpc.GetTransactionCount(self.signer.Address())
+	if err != nil {
+		log.Println("Failed to get nonce:", err)
+		return
+	}
+
+	for _, p := range plan.Payments {
+		// Operator checked block explorer, payments actually made must have been set to sent with their tx ids
+		if p.State == storage.PaymentUnresolved {
+			p.State = storage.PaymentFailed
+			err := self.backend.FailPlannedPayment(plan.Id, p)
+			if err != nil {
+				log.Printf("Failed to credit %v Wei of %s back to %s, error is: %v", p.Amount, p.Token, p.Address, err)
+				return
+			}
+			log.Printf("Credited unresolved %v Wei of %s back to %s", p.Amount, p.Token, p.Address)
+			continue
+		}
+		if p.State != storage.PaymentNew {
+			continue
+		}
+		if p.Nonce < nonce {
+			log.Printf("Nonce %v of payment to %s is already used, leaving it to confirmations tracker", p.Nonce, p.Address)
+			continue
+		}
+		p.State = storage.PaymentFailed
+		err := self.backend.FailPlannedPayment(plan.Id, p)
+		if err != nil {
+			log.Printf("Failed to credit %v Wei of %s back to %s, error is: %v", p.Amount, p.Token, p.Address, err)
+			return
+		}
+		log.Printf("Credited %v Wei of %s back to %s", p.Amount, p.Token, p.Address)
+	}
+
+	if !plan.Done() {
+		log.Printf("Payout plan %s still has sent payments, they will be confirmed on normal run", plan.Id)
+		return
+	}
+	err = self.backend.FinishPayoutPlan(plan.Id)
+	if err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		return
+	}
+	if self.config.BgSave {
+		self.bgSave()
+	}
+	log.Println("Payouts unlocked")
+}
+
+func (self *PayoutsProcessor) mustResolvePayout() bool {
 	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
 	return v
 }
@@ -0,0 +1,96 @@
+package payouts
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sammy007/open-ethereum-pool/rpc"
+	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+func TestBumpGasPrice(t *testing.T) {
+	u := &PayoutsProcessor{config: &PayoutsConfig{GasPrice: "1000000000", GasPriceBump: 20, MaxGasPrice: "1300000000"}}
+
+	if price := u.bumpGasPrice(nil); price.Int64() != 1200000000 {
+		t.Errorf("Configured gas price must be bumped, got %v", price)
+	}
+	if price := u.bumpGasPrice(big.NewInt(1200000000)); price.Int64() != 1300000000 {
+		t.Errorf("Gas price must be capped, got %v", price)
+	}
+	if price := u.bumpGasPrice(big.NewInt(1500000000)); price.Int64() != 1500000000 {
+		t.Errorf("Gas price above maximum must be kept, got %v", price)
+	}
+}
+
+func TestCollectPayments(t *testing.T) {
+	backend := storage.NewMemoryClient("test")
+	backend.RollbackBalance("0x1", util.DefaultToken, big.NewInt(6e17))
+	backend.RollbackBalance("0x1", "QI", big.NewInt(2e17))
+	backend.RollbackBalance("0x2", util.DefaultToken, big.NewInt(4e17))
+	backend.RollbackBalance("0x3", util.DefaultToken, big.NewInt(1e18))
+
+	// 0.5 QKC, QI is paid above 0.1, others never
+	u := &PayoutsProcessor{config: &PayoutsConfig{Threshold: 500000000, TokenThresholds: map[string]int64{"QI": 100000000}}, backend: backend}
+	payments, totals, err := u.collectPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 3 {
+		t.Errorf("Invalid payments %v", payments)
+	}
+	if totals[util.DefaultToken].Cmp(big.NewInt(16e17)) != 0 || totals["QI"].Cmp(big.NewInt(2e17)) != 0 {
+		t.Errorf("Invalid totals %v", totals)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Collecting payments must not lock payouts")
+	}
+
+	missing := shortfalls(totals, map[string]*big.Int{util.DefaultToken: big.NewInt(1e18)})
+	if len(missing) != 2 || missing[util.DefaultToken].Cmp(big.NewInt(6e17)) != 0 || missing["QI"].Cmp(big.NewInt(2e17)) != 0 {
+		t.Errorf("Invalid shortfalls %v", missing)
+	}
+}
+
+func TestPoolBalances(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []string `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		requested = req.Params[0]
+		balances := []map[string]string{{"tokenStr": "QKC", "balance": "0xde0b6b3a7640000"}}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": map[string]interface{}{"balances": balances}})
+	}))
+	defer server.Close()
+
+	// Configured address carries full shard key already
+	cfg := &PayoutsConfig{Address: "0xdb7FD07891697f74A7E5102Cc2cC522c25dc06e900010000", ShardId: "0x10001"}
+	u := &PayoutsProcessor{config: cfg, rpc: rpc.NewRPCClient("test", server.URL, "1s")}
+	balances, err := u.poolBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != "0xdb7FD07891697f74A7E5102Cc2cC522c25dc06e900010000" {
+		t.Errorf("Invalid pool address %s", requested)
+	}
+	if balances[util.DefaultToken].String() != "1000000000000000000" {
+		t.Errorf("Invalid pool balances %v", balances)
+	}
+}
+
+func TestNewPayoutsPreviewer(t *testing.T) {
+	backend := storage.NewMemoryClient("test")
+	for _, shardId := range []string{"", "0x", "0x10000"} {
+		if _, err := NewPayoutsPreviewer(&PayoutsConfig{ShardId: shardId}, backend); err == nil {
+			t.Errorf("Invalid shard id %q must be refused", shardId)
+		}
+	}
+	if _, err := NewPayoutsPreviewer(&PayoutsConfig{ShardId: "0x10001", Timeout: "1s"}, backend); err != nil {
+		t.Error(err)
+	}
+}
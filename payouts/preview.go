@@ -0,0 +1,65 @@
+package payouts
+
+import (
+	"math/big"
+	"sort"
+)
+
+type PreviewPayment struct {
+	Address string   `json:"address"`
+	Token   string   `json:"token"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// What the next payout run would send, amounts in Wei
+type PayoutPreview struct {
+	Payments     []*PreviewPayment   `json:"payments"`
+	Totals       map[string]*big.Int `json:"totals"`
+	PoolBalances map[string]*big.Int `json:"poolBalances"`
+	// Missing amount of every token pool doesn't have enough of
+	Shortfalls map[string]*big.Int `json:"shortfalls"`
+	Sufficient bool                `json:"sufficient"`
+	// Unfinished plan is resumed before new payees are paid
+	Locked bool `json:"locked"`
+}
+
+// Previews next payout run against current balances, nothing is locked, debited or sent
+func (u *PayoutsProcessor) DryRun() (*PayoutPreview, error) {
+	payments, totals, err := u.collectPayments()
+	if err != nil {
+		return nil, err
+	}
+	preview := &PayoutPreview{Payments: make([]*PreviewPayment, 0, len(payments)), Totals: totals}
+	for _, p := range payments {
+		preview.Payments = append(preview.Payments, &PreviewPayment{Address: p.Address, Token: p.Token, Amount: p.Amount})
+	}
+	sort.Slice(preview.Payments, func(i, j int) bool {
+		return preview.Payments[i].Amount.Cmp(preview.Payments[j].Amount) > 0
+	})
+
+	preview.Locked, err = u.backend.IsPayoutsLocked()
+	if err != nil {
+		return nil, err
+	}
+	preview.PoolBalances, err = u.poolBalances()
+	if err != nil {
+		return nil, err
+	}
+	preview.Shortfalls = shortfalls(totals, preview.PoolBalances)
+	preview.Sufficient = len(preview.Shortfalls) == 0
+	return preview, nil
+}
+
+func shortfalls(totals, balances map[string]*big.Int) map[string]*big.Int {
+	result := make(map[string]*big.Int)
+	for token, total := range totals {
+		balance := balances[token]
+		if balance == nil {
+			balance = big.NewInt(0)
+		}
+		if balance.Cmp(total) < 0 {
+			result[token] = new(big.Int).Sub(total, balance)
+		}
+	}
+	return result
+}
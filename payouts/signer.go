@@ -0,0 +1,234 @@
+package payouts
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// QuarkChain EVM transaction, field order must match pyquarkchain EvmTransaction
+type Transaction struct {
+	Nonce            uint64
+	GasPrice         *big.Int
+	Gas              uint64
+	To               common.Address
+	Value            *big.Int
+	Data             []byte
+	NetworkId        uint64
+	FromFullShardKey [4]byte
+	ToFullShardKey   [4]byte
+	GasTokenId       uint64
+	TransferTokenId  uint64
+	Version          uint64
+	V                *big.Int
+	R                *big.Int
+	S                *big.Int
+}
+
+// Same as Transaction without signature, it's what gets hashed for signing
+type unsignedTransaction struct {
+	Nonce            uint64
+	GasPrice         *big.Int
+	Gas              uint64
+	To               common.Address
+	Value            *big.Int
+	Data             []byte
+	NetworkId        uint64
+	FromFullShardKey [4]byte
+	ToFullShardKey   [4]byte
+	GasTokenId       uint64
+	TransferTokenId  uint64
+	Version          uint64
+}
+
+type Signer struct {
+	key              *ecdsa.PrivateKey
+	address          common.Address
+	networkId        uint64
+	fromFullShardKey [4]byte
+	toFullShardKey   [4]byte
+	gasTokenId       uint64
+}
+
+func NewSigner(cfg *PayoutsConfig) (*Signer, error) {
+	key, err := loadKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Signer{key: key, address: crypto.PubkeyToAddress(key.PublicKey)}
+
+	if len(cfg.Address) < 42 || !strings.EqualFold(s.address.Hex(), cfg.Address[:42]) {
+		return nil, fmt.Errorf("Key for %s does not match payouts address %s", s.address.Hex(), cfg.Address)
+	}
+	s.networkId, err = parseHexUint(cfg.NetworkId, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid networkId: %v", err)
+	}
+
+	fromKey := cfg.FromFullShardKey
+	if len(fromKey) == 0 {
+		fromKey = fullShardKeyOf(cfg.Address)
+	}
+	s.fromFullShardKey, err = parseFullShardKey(fromKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fromFullShardKey: %v", err)
+	}
+	s.toFullShardKey = s.fromFullShardKey
+	if len(cfg.ToFullShardKey) > 0 {
+		s.toFullShardKey, err = parseFullShardKey(cfg.ToFullShardKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid toFullShardKey: %v", err)
+		}
+	}
+
+	s.gasTokenId, err = tokenId(cfg.GasToken)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Key is taken either from encrypted keystore file or from a plain hex key file
+func loadKey(cfg *PayoutsConfig) (*ecdsa.PrivateKey, error) {
+	if len(cfg.KeystoreFile) > 0 {
+		keyJson, err := ioutil.ReadFile(cfg.KeystoreFile)
+		if err != nil {
+			return nil, err
+		}
+		password, err := ioutil.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := keystore.DecryptKey(keyJson, strings.TrimSpace(string(password)))
+		if err != nil {
+			return nil, fmt.Errorf("Can't decrypt keystore %s: %v", cfg.KeystoreFile, err)
+		}
+		return key.PrivateKey, nil
+	}
+	if len(cfg.KeyFile) > 0 {
+		return crypto.LoadECDSA(cfg.KeyFile)
+	}
+	return nil, errors.New("Either keystoreFile or keyFile must be set to sign payouts")
+}
+
+// QuarkChain address of the signer in a form accepted by RPC: 20 bytes account + 4 bytes full shard key
+func (s *Signer) Address() string {
+	return strings.ToLower(s.address.Hex()) + hexutil.Encode(s.fromFullShardKey[:])[2:]
+}
+
+// Value is transferred in given native token, gas is always paid in configured gas token
+func (s *Signer) NewTransaction(nonce uint64, to, token string, value, gas, gasPrice *big.Int) (*Transaction, error) {
+	transferTokenId, err := tokenId(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{
+		Nonce:            nonce,
+		GasPrice:         gasPrice,
+		Gas:              gas.Uint64(),
+		To:               common.HexToAddress(to),
+		Value:            value,
+		Data:             []byte{},
+		NetworkId:        s.networkId,
+		FromFullShardKey: s.fromFullShardKey,
+		ToFullShardKey:   s.toFullShardKey,
+		GasTokenId:       s.gasTokenId,
+		TransferTokenId:  transferTokenId,
+	}, nil
+}
+
+func (s *Signer) Sign(tx *Transaction) error {
+	hash, err := tx.signingHash()
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.Sign(hash, s.key)
+	if err != nil {
+		return err
+	}
+	tx.R = new(big.Int).SetBytes(sig[:32])
+	tx.S = new(big.Int).SetBytes(sig[32:64])
+	tx.V = new(big.Int).SetInt64(int64(sig[64]) + 27)
+	return nil
+}
+
+func (tx *Transaction) signingHash() ([]byte, error) {
+	data, err := rlp.EncodeToBytes(&unsignedTransaction{
+		Nonce:            tx.Nonce,
+		GasPrice:         tx.GasPrice,
+		Gas:              tx.Gas,
+		To:               tx.To,
+		Value:            tx.Value,
+		Data:             tx.Data,
+		NetworkId:        tx.NetworkId,
+		FromFullShardKey: tx.FromFullShardKey,
+		ToFullShardKey:   tx.ToFullShardKey,
+		GasTokenId:       tx.GasTokenId,
+		TransferTokenId:  tx.TransferTokenId,
+		Version:          tx.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// Hex encoded payload for sendRawTransaction
+func (tx *Transaction) RawHex() (string, error) {
+	if tx.V == nil {
+		return "", errors.New("Transaction is not signed")
+	}
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(data), nil
+}
+
+// Last 4 bytes of 24 bytes QuarkChain address
+func fullShardKeyOf(address string) string {
+	address = strings.Replace(address, "0x", "", -1)
+	if len(address) != 48 {
+		return ""
+	}
+	return "0x" + address[40:]
+}
+
+func parseFullShardKey(s string) ([4]byte, error) {
+	var key [4]byte
+	n, err := parseHexUint(s, 32)
+	if err != nil {
+		return key, err
+	}
+	key[0] = byte(n >> 24)
+	key[1] = byte(n >> 16)
+	key[2] = byte(n >> 8)
+	key[3] = byte(n)
+	return key, nil
+}
+
+func parseHexUint(s string, bits int) (uint64, error) {
+	if len(s) == 0 {
+		return 0, errors.New("empty value")
+	}
+	return strconv.ParseUint(strings.Replace(s, "0x", "", -1), 16, bits)
+}
+
+func tokenId(name string) (uint64, error) {
+	if len(name) == 0 {
+		name = util.DefaultToken
+	}
+	return util.TokenIdEncode(strings.ToUpper(name))
+}
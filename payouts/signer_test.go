@@ -0,0 +1,39 @@
+package payouts
+
+import (
+	"testing"
+)
+
+func TestTokenId(t *testing.T) {
+	id, err := tokenId("")
+	if err != nil || id != 35760 {
+		t.Errorf("Default token must be QKC 35760, got %v: %v", id, err)
+	}
+	id, _ = tokenId("qkc")
+	if id != 35760 {
+		t.Errorf("Token name must be case insensitive, got %v", id)
+	}
+	if _, err = tokenId("QK-C"); err == nil {
+		t.Error("Must reject invalid token name")
+	}
+}
+
+func TestFullShardKey(t *testing.T) {
+	s := fullShardKeyOf("0xdb7FD07891697f74A7E5102Cc2cC522c25dc06e900010000")
+	if s != "0x00010000" {
+		t.Errorf("Must take full shard key from address, got %v", s)
+	}
+	if fullShardKeyOf("0xdb7FD07891697f74A7E5102Cc2cC522c25dc06e9") != "" {
+		t.Error("Must not take full shard key from 20 bytes address")
+	}
+	key, err := parseFullShardKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != [4]byte{0, 1, 0, 0} {
+		t.Errorf("Must encode full shard key as 4 bytes big endian, got %v", key)
+	}
+	if _, err = parseFullShardKey("0x100000000"); err == nil {
+		t.Error("Must reject full shard key wider than 4 bytes")
+	}
+}
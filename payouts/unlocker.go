@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/math"
@@ -19,17 +20,92 @@ type UnlockerConfig struct {
 	Enabled        bool    `json:"enabled"`
 	PoolFee        float64 `json:"poolFee"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
+	// Fee percentage charged from blocks found on solo stratum
+	SoloFee float64 `json:"soloFee"`
 	Donate         bool    `json:"donate"`
 	Depth          int64   `json:"depth"`
 	ImmatureDepth  int64   `json:"immatureDepth"`
+	// Number of root blocks kept in root index, also walked back on the first start, 4 x depth by default
+	RootWindow int64 `json:"rootWindow"`
 	KeepTxFees     bool    `json:"keepTxFees"`
 	Interval       string  `json:"interval"`
 	Daemon         string  `json:"daemon"`
 	Timeout        string  `json:"timeout"`
 	ShardId        string  `json:"shardId"`
+	// "prop" (default) splits reward over block round, "pplns" over last N shares,
+	// "pps" and "fpps" pay every share immediately in proxy
+	PayoutScheme string      `json:"payoutScheme"`
+	PPLNS        PPLNSConfig `json:"pplns"`
+	PPS          PPSConfig   `json:"pps"`
+}
+
+type PPLNSConfig struct {
+	// Window N as a multiple of network difficulty, used if shares is not set
+	Window float64 `json:"window"`
+	// Window N as a number of last shares
+	Shares int64 `json:"shares"`
+	// Number of last shares kept in a share log by proxy, must cover window
+	LogSize int64 `json:"logSize"`
+}
+
+type PPSConfig struct {
+	// Expected block reward in Wei for PPS, also used by FPPS until there are matured blocks
+	BlockReward string `json:"blockReward"`
+	// FPPS pays average reward of this number of last matured blocks, tx fees included
+	AvgWindow int64 `json:"avgWindow"`
+}
+
+const (
+	SchemeProp  = "prop"
+	SchemePPLNS = "pplns"
+	SchemePPS   = "pps"
+	SchemeFPPS  = "fpps"
+)
+
+const defaultPPSAvgWindow = 100
+
+const defaultPPLNSWindow = 2.0
+const defaultShareLogSize = 1000000
+
+func (c *UnlockerConfig) IsPPLNS() bool {
+	return c.PayoutScheme == SchemePPLNS
+}
+
+func (c *UnlockerConfig) IsPPS() bool {
+	return c.PayoutScheme == SchemePPS || c.PayoutScheme == SchemeFPPS
+}
+
+// Number of matured blocks to average for FPPS reward
+func (c *UnlockerConfig) PPSAvgWindow() int64 {
+	if c.PPS.AvgWindow > 0 {
+		return c.PPS.AvgWindow
+	}
+	return defaultPPSAvgWindow
+}
+
+// Root blocks kept in root index, must cover time between block inclusion into root chain and its maturity
+func (c *UnlockerConfig) RootIndexWindow() int64 {
+	if c.RootWindow > 0 {
+		return c.RootWindow
+	}
+	return c.Depth * 4
+}
+
+// Share log size to configure on backend, 0 if share log is not needed
+func (c *UnlockerConfig) ShareLogSize() int64 {
+	if !c.IsPPLNS() {
+		return 0
+	}
+	if c.PPLNS.LogSize > 0 {
+		return c.PPLNS.LogSize
+	}
+	return defaultShareLogSize
 }
 
 const minDepth = 8
+
+// Max number of root blocks indexed in one unlocker iteration
+const maxRootWalk = 1000
 const byzantiumHardForkHeight = 4370000
 
 var homesteadReward = math.MustParseBig256("5000000000000000000")
@@ -41,13 +117,15 @@ const donationAccount = "0xAAdB54c8fB14f588AfA3Bb118b8AbDE7EE1928c700000000"
 
 type BlockUnlocker struct {
 	config   *UnlockerConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
 	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	health   *health
+	// Held while unlocking, Stop waits for the current iteration
+	runMu   sync.Mutex
+	stopped bool
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
+func NewBlockUnlocker(cfg *UnlockerConfig, backend storage.Backend) *BlockUnlocker {
 	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
 		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
 	}
@@ -57,7 +135,25 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
 	if cfg.ImmatureDepth < minDepth {
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
+	switch cfg.PayoutScheme {
+	case "":
+		cfg.PayoutScheme = SchemeProp
+	case SchemeProp:
+	case SchemePPLNS:
+		if cfg.PPLNS.Shares <= 0 && cfg.PPLNS.Window <= 0 {
+			cfg.PPLNS.Window = defaultPPLNSWindow
+		}
+		if cfg.PPLNS.Shares > cfg.ShareLogSize() {
+			log.Fatalf("PPLNS window of %v shares doesn't fit into share log of %v shares", cfg.PPLNS.Shares, cfg.ShareLogSize())
+		}
+	case SchemePPS, SchemeFPPS:
+		if util.String2Big(cfg.PPS.BlockReward).Sign() <= 0 {
+			log.Fatalln("PPS blockReward must be set for", cfg.PayoutScheme)
+		}
+	default:
+		log.Fatalln("Invalid payoutScheme", cfg.PayoutScheme)
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, health: &health{name: "Block unlocker " + cfg.ShardId}}
 	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
 	return u
 }
@@ -69,22 +165,52 @@ func (u *BlockUnlocker) Start() {
 	log.Printf("Set block unlock interval to %v", intv)
 
 	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
-	timer.Reset(intv)
+	timer.Reset(u.run(intv))
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
-				u.unlockPendingBlocks()
-				u.unlockAndCreditMiners()
-				timer.Reset(intv)
+				timer.Reset(u.run(intv))
 			}
 		}
 	}()
 }
 
+// Returns delay before next iteration, shorter one if iteration failed with transient error
+func (u *BlockUnlocker) run(intv time.Duration) time.Duration {
+	u.runMu.Lock()
+	defer u.runMu.Unlock()
+	if u.stopped {
+		return intv
+	}
+	u.health.begin()
+	index := u.indexRootChain()
+	if index != nil {
+		u.unlockPendingBlocks(index)
+		u.unlockAndCreditMiners(index)
+	}
+	return u.health.end(intv)
+}
+
+func (u *BlockUnlocker) Status() HealthStatus {
+	return u.health.status()
+}
+
+// Clears halt after critical error and unlocks immediately
+func (u *BlockUnlocker) Resume() {
+	u.health.resume()
+	go u.run(util.MustParseDuration(u.config.Interval))
+}
+
+// Waits for the current iteration and disables further ones
+func (u *BlockUnlocker) Stop() {
+	u.runMu.Lock()
+	defer u.runMu.Unlock()
+	u.stopped = true
+	log.Println("Block unlocker stopped")
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -123,7 +249,7 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 				return nil, err
 			}
 			if block == nil {
-				return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
+				return nil, transient(fmt.Errorf("Error while retrieving block %v from node, wrong node height", height))
 			}
 
 			if matchCandidate(block, candidate) {
@@ -132,8 +258,6 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 
 				err = u.handleBlock(block, candidate)
 				if err != nil {
-					u.halt = true
-					u.lastFail = err
 					return nil, err
 				}
 				result.maturedBlocks = append(result.maturedBlocks, candidate)
@@ -232,8 +356,13 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	candidate.Hash = block.Hash
 
 	reward := new(big.Int)
+	candidate.TokenRewards = make(map[string]*big.Int)
 	for _, coinbase_map := range block.Coinbase {
-		if coinbase_map.TokenStr !=  "QKC" {
+		token := strings.ToUpper(coinbase_map.TokenStr)
+		if token != util.DefaultToken {
+			if amount := util.String2Big(coinbase_map.Balance); amount.Sign() > 0 {
+				candidate.TokenRewards[token] = amount
+			}
 			continue
 		}
 		candidate.RewardString = strings.Replace(coinbase_map.Balance, "0x", "", -1)
@@ -257,45 +386,155 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 //	return nil
 //}
 
-func (u *BlockUnlocker) unlockPendingBlocks() {
-	if u.halt {
-		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
+// Walks root chain from last indexed root block and indexes minor blocks of pool shard by hash,
+// so maturity is counted in root blocks confirming exactly the block we found
+func (u *BlockUnlocker) indexRootChain() *storage.RootIndex {
+	if u.health.isHalted() {
+		log.Println("Unlocking suspended due to last critical error:", u.health.status().LastError)
+		return nil
 	}
 
 	current, err := u.rpc.GetLastestRootBlock()
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Unable to get current blockchain height from node: %v", err)
-		return
+		u.health.fail(err)
+		log.Printf("Unable to get current root chain height from node: %v", err)
+		return nil
 	}
 	currentHeight, err := strconv.ParseInt(strings.Replace(current, "0x", "", -1), 16, 64)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Can't parse pending block number: %v", err)
-		return
+		u.health.fail(err)
+		log.Printf("Can't parse root block number: %v", err)
+		return nil
+	}
+
+	index, err := u.backend.GetRootIndex()
+	if err != nil {
+		u.health.fail(err)
+		log.Printf("Failed to get root index from backend: %v", err)
+		return nil
+	}
+	if index == nil {
+		index = &storage.RootIndex{Height: currentHeight - u.config.RootIndexWindow()}
+		if index.Height < -1 {
+			index.Height = -1
+		}
+		log.Printf("Building root index from root block %v", index.Height+1)
 	}
 
-	finalized_current, err := u.rpc.GetRootBlockByHeight(u.config.ShardId, currentHeight - u.config.ImmatureDepth)
+	for walked := 0; index.Height < currentHeight && walked < maxRootWalk; walked++ {
+		height := index.Height + 1
+		root, err := u.rpc.GetRootBlock(height)
+		if err != nil {
+			u.health.fail(err)
+			log.Printf("Error while retrieving root block %v from node: %v", height, err)
+			return nil
+		}
+		if root == nil {
+			break
+		}
+
+		// Root chain reorganized, drop confirmations of replaced root blocks and walk them again
+		if len(index.Hash) > 0 && !strings.EqualFold(root.ParentHash, index.Hash) {
+			index, err = u.rewindRootIndex(index)
+			if err != nil {
+				u.health.fail(err)
+				log.Printf("Failed to rewind root index: %v", err)
+				return nil
+			}
+			log.Printf("Root block %v doesn't follow indexed chain, rewound root index to %v", height, index.Height)
+			continue
+		}
+
+		var minorHashes []string
+		for _, header := range root.MinorBlockHeaders {
+			if header.FullShardId != u.config.ShardId {
+				continue
+			}
+			minorHeight, err := strconv.ParseInt(strings.Replace(header.Height, "0x", "", -1), 16, 64)
+			if err != nil {
+				u.health.fail(err)
+				log.Printf("Can't parse minor block height in root block %v: %v", height, err)
+				return nil
+			}
+			if minorHeight > index.MinorHeight {
+				index.MinorHeight = minorHeight
+			}
+			minorHashes = append(minorHashes, header.Hash)
+		}
+		index.Height = height
+		index.Hash = root.Hash
+		err = u.backend.WriteRootBlock(index, minorHashes, u.config.RootIndexWindow())
+		if err != nil {
+			u.health.fail(err)
+			log.Printf("Failed to write root block %v to backend: %v", height, err)
+			return nil
+		}
+	}
+	return index
+}
 
-	if finalized_current == "" {
-		return 
+// Walks back until indexed root block matches node's one, minor blocks above it are indexed again.
+// Reorganization deeper than root index window rebuilds index from where it's lost.
+func (u *BlockUnlocker) rewindRootIndex(index *storage.RootIndex) (*storage.RootIndex, error) {
+	for height := index.Height; height >= 0; height-- {
+		indexed, err := u.backend.GetIndexedRoot(height)
+		if err != nil {
+			return nil, err
+		}
+		if indexed == nil {
+			log.Printf("Root chain reorganized deeper than root index window, rebuilding index from root block %v", height+1)
+			rewound := &storage.RootIndex{Height: height}
+			return rewound, u.backend.RewindRootIndex(rewound)
+		}
+		root, err := u.rpc.GetRootBlock(height)
+		if err != nil {
+			return nil, err
+		}
+		if root == nil {
+			return nil, transient(fmt.Errorf("Root block %v is missing on node", height))
+		}
+		if strings.EqualFold(root.Hash, indexed.Hash) {
+			return indexed, u.backend.RewindRootIndex(indexed)
+		}
 	}
+	rewound := &storage.RootIndex{Height: -1}
+	return rewound, u.backend.RewindRootIndex(rewound)
+}
 
-	finalized_height, err := strconv.ParseInt(strings.Replace(finalized_current, "0x", "", -1), 16, 64)
+// Leaves blocks confirmed by at least depth root blocks, others wait for next iterations
+func (u *BlockUnlocker) filterRootConfirmed(blocks []*storage.BlockData, index *storage.RootIndex, depth int64) ([]*storage.BlockData, error) {
+	hashes := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	confirmations, err := u.backend.GetRootConfirmations(hashes)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Can't parse the latest minor blocks height: %v", err)
-		return
+		return nil, err
 	}
 
-	candidates, err := u.backend.GetCandidates(finalized_height)
+	var result []*storage.BlockData
+	for _, block := range blocks {
+		rootHeight, ok := confirmations[strings.ToLower(block.Hash)]
+		if !ok {
+			log.Printf("Block %v %v is not confirmed by root chain yet", block.Height, block.Hash)
+			continue
+		}
+		block.RootHeight = rootHeight
+		block.RootConfirmations = index.Confirmations(rootHeight)
+		if block.RootConfirmations <= depth {
+			log.Printf("Block %v %v has %v of %v root confirmations", block.Height, block.Hash, block.RootConfirmations, depth+1)
+			continue
+		}
+		result = append(result, block)
+	}
+	return result, nil
+}
+
+func (u *BlockUnlocker) unlockPendingBlocks(index *storage.RootIndex) {
+	// Only heights confirmed by root chain exist on node for sure
+	candidates, err := u.backend.GetCandidates(index.MinorHeight)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.health.fail(err)
 		log.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -307,8 +546,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	result, err := u.unlockCandidates(candidates)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.health.fail(err)
 		log.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -316,30 +554,42 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	err = u.backend.WritePendingOrphans(result.orphanedBlocks)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.health.fail(err)
 		log.Printf("Failed to insert orphaned blocks into backend: %v", err)
 		return
 	} else {
 		log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 	}
 
+	confirmed, err := u.filterRootConfirmed(result.maturedBlocks, index, u.config.ImmatureDepth)
+	if err != nil {
+		u.health.fail(err)
+		log.Printf("Failed to get root confirmations from backend: %v", err)
+		return
+	}
+
 	totalRevenue := new(big.Rat)
 	totalMinersProfit := new(big.Rat)
 	totalPoolProfit := new(big.Rat)
 
-	for _, block := range result.maturedBlocks {
+	for _, block := range confirmed {
+		if u.config.IsPPLNS() && !block.Solo {
+			err := u.applyPPLNSWindow(block)
+			if err != nil {
+				u.health.fail(err)
+				log.Printf("Failed to collect PPLNS window for round %v: %v", block.RoundKey(), err)
+				return
+			}
+		}
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.health.fail(err)
 			log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
 		err = u.backend.WriteImmatureBlock(block, roundRewards)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.health.fail(err)
 			log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
@@ -355,8 +605,10 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 			util.FormatRatReward(poolProfit),
 		)
 		entries := []string{logEntry}
-		for login, reward := range roundRewards {
-			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
+		for token, rewards := range roundRewards {
+			for login, reward := range rewards {
+				entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Wei of %v", block.RoundKey(), login, reward, token))
+			}
 		}
 		log.Println(strings.Join(entries, "\n"))
 	}
@@ -369,46 +621,13 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 	)
 }
 
-func (u *BlockUnlocker) unlockAndCreditMiners() {
-	if u.halt {
-		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
-		return
-	}
-
-	current, err := u.rpc.GetLastestRootBlock()
-	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Unable to get current blockchain height from node: %v", err)
+func (u *BlockUnlocker) unlockAndCreditMiners(index *storage.RootIndex) {
+	if u.health.suspended() {
 		return
 	}
-	currentHeight, err := strconv.ParseInt(strings.Replace(current, "0x", "", -1), 16, 64)
+	immature, err := u.backend.GetImmatureBlocks(index.MinorHeight)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Can't parse pending block number: %v", err)
-		return
-	}
-
-	finalized_current, err := u.rpc.GetRootBlockByHeight(u.config.ShardId, currentHeight - u.config.Depth)
-
-	if finalized_current == "" {
-		return
-	}
-
-	finalized_height, err := strconv.ParseInt(strings.Replace(finalized_current, "0x", "", -1), 16, 64)
-	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Can't parse the latest minor blocks height in unlockedAndCreditMiners function: %v", err)
-		return
-	}
-
-
-	immature, err := u.backend.GetImmatureBlocks(finalized_height)
-	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.health.fail(err)
 		log.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -420,8 +639,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 	result, err := u.unlockCandidates(immature)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.health.fail(err)
 		log.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -430,30 +648,38 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	for _, block := range result.orphanedBlocks {
 		err = u.backend.WriteOrphan(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.health.fail(err)
 			log.Printf("Failed to insert orphaned block into backend: %v", err)
 			return
 		}
 	}
 	log.Printf("Inserted %v orphaned blocks to backend", result.orphans)
 
+	confirmed, err := u.filterRootConfirmed(result.maturedBlocks, index, u.config.Depth)
+	if err != nil {
+		u.health.fail(err)
+		log.Printf("Failed to get root confirmations from backend: %v", err)
+		return
+	}
+
 	totalRevenue := new(big.Rat)
 	totalMinersProfit := new(big.Rat)
 	totalPoolProfit := new(big.Rat)
 
-	for _, block := range result.maturedBlocks {
+	for _, block := range confirmed {
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.health.fail(err)
 			log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		if u.config.IsPPS() && !block.Solo {
+			err = u.backend.WritePPSMaturedBlock(block, roundRewards)
+		} else {
+			err = u.backend.WriteMaturedBlock(block, roundRewards)
+		}
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.health.fail(err)
 			log.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
@@ -469,8 +695,10 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 			util.FormatRatReward(poolProfit),
 		)
 		entries := []string{logEntry}
-		for login, reward := range roundRewards {
-			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
+		for token, rewards := range roundRewards {
+			for login, reward := range rewards {
+				entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Wei of %v", block.RoundKey(), login, reward, token))
+			}
 		}
 		log.Println(strings.Join(entries, "\n"))
 	}
@@ -483,18 +711,62 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	)
 }
 
-func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
-	revenue := new(big.Rat).SetInt(block.Reward)
+// Splits coinbase of every native token, revenue and profits are returned for default token
+func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, storage.TokenRewards, error) {
+	rewards := make(storage.TokenRewards)
+	var shares map[string]int64
+	roundShares := func() (map[string]int64, error) {
+		var err error
+		if shares == nil {
+			shares, err = u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+		}
+		return shares, err
+	}
+
+	revenue, minersProfit, poolProfit, tokenRewards, err := u.calculateTokenRewards(block, util.DefaultToken, block.Reward, roundShares)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	rewards[util.DefaultToken] = tokenRewards
+	for token, reward := range block.TokenRewards {
+		_, _, _, tokenRewards, err = u.calculateTokenRewards(block, token, reward, roundShares)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		rewards[token] = tokenRewards
+	}
+	return revenue, minersProfit, poolProfit, rewards, nil
+}
+
+func (u *BlockUnlocker) calculateTokenRewards(block *storage.BlockData, token string, reward *big.Int, roundShares func() (map[string]int64, error)) (*big.Rat, *big.Rat, *big.Rat, map[string]*big.Int, error) {
+	revenue := new(big.Rat).SetInt(reward)
+
+	if block.Solo {
+		minersProfit, poolProfit, rewards := u.calculateSoloRewards(block, revenue)
+		return revenue, minersProfit, poolProfit, rewards, nil
+	}
+
+	// Shares were paid by proxy already, whole reward covers PPS liability
+	if u.config.IsPPS() && token == util.DefaultToken {
+		return revenue, new(big.Rat), new(big.Rat).Set(revenue), make(map[string]*big.Int), nil
+	}
+
 	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+	shares, err := roundShares()
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
+	// Round shares are replaced by PPLNS window, so block.TotalShares is not always a total of them
+	totalShares := int64(0)
+	for _, n := range shares {
+		totalShares += n
+	}
+	rewards := calculateRewardsForShares(shares, totalShares, minersProfit)
 
-	if block.ExtraReward != nil {
+	// Transaction fees are paid in default token only
+	if block.ExtraReward != nil && token == util.DefaultToken {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
 		poolProfit.Add(poolProfit, extraReward)
 		revenue.Add(revenue, extraReward)
@@ -504,24 +776,59 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 		var donation = new(big.Rat)
 		poolProfit, donation = chargeFee(poolProfit, donationFee)
 		login := strings.ToLower(donationAccount)
-		rewards[login] += weiToShannonInt64(donation)
+		addReward(rewards, login, donation)
 	}
 
 	if len(u.config.PoolFeeAddress) != 0 {
 		address := strings.ToLower(u.config.PoolFeeAddress)
-		rewards[address] += weiToShannonInt64(poolProfit)
+		addReward(rewards, address, poolProfit)
 	}
 
 	return revenue, minersProfit, poolProfit, rewards, nil
 }
 
-func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
-	rewards := make(map[string]int64)
+// Finder of solo block gets whole reward minus solo fee
+func (u *BlockUnlocker) calculateSoloRewards(block *storage.BlockData, revenue *big.Rat) (*big.Rat, *big.Rat, map[string]*big.Int) {
+	minersProfit, poolProfit := chargeFee(revenue, u.config.SoloFee)
+	rewards := make(map[string]*big.Int)
+	addReward(rewards, strings.ToLower(block.Coinbase), minersProfit)
+
+	if len(u.config.PoolFeeAddress) != 0 {
+		address := strings.ToLower(u.config.PoolFeeAddress)
+		addReward(rewards, address, poolProfit)
+	}
+	return minersProfit, poolProfit, rewards
+}
+
+// Replaces block round shares with last N shares before the block, so both immature
+// and matured credits are calculated using the same window even if share log rolls over
+func (u *BlockUnlocker) applyPPLNSWindow(block *storage.BlockData) error {
+	if block.ShareSeq == 0 {
+		log.Printf("No share log position for round %v, paying it proportionally", block.RoundKey())
+		return nil
+	}
+	maxDiff := int64(0)
+	if u.config.PPLNS.Shares <= 0 {
+		maxDiff = int64(u.config.PPLNS.Window * float64(block.Difficulty))
+	}
+	shares, err := u.backend.GetShareWindow(block.ShareSeq, u.config.PPLNS.Shares, maxDiff)
+	if err != nil {
+		return err
+	}
+	if len(shares) == 0 {
+		log.Printf("Share log is empty for round %v, paying it proportionally", block.RoundKey())
+		return nil
+	}
+	return u.backend.ReplaceRoundShares(block.RoundHeight, block.Nonce, shares)
+}
+
+func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]*big.Int {
+	rewards := make(map[string]*big.Int)
 
 	for login, n := range shares {
 		percent := big.NewRat(n, total)
 		workerReward := new(big.Rat).Mul(reward, percent)
-		rewards[login] += weiToShannonInt64(workerReward)
+		addReward(rewards, login, workerReward)
 	}
 	return rewards
 }
@@ -533,11 +840,16 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
 	return new(big.Rat).Sub(value, feeValue), feeValue
 }
 
-func weiToShannonInt64(wei *big.Rat) int64 {
-	shannon := new(big.Rat).SetInt(util.Shannon)
-	inShannon := new(big.Rat).Quo(wei, shannon)
-	value, _ := strconv.ParseInt(inShannon.FloatString(0), 10, 64)
-	return value
+func addReward(rewards map[string]*big.Int, login string, wei *big.Rat) {
+	if rewards[login] == nil {
+		rewards[login] = new(big.Int)
+	}
+	rewards[login].Add(rewards[login], ratToWei(wei))
+}
+
+// Truncates fractional Wei, so credits never exceed the reward they are split from
+func ratToWei(wei *big.Rat) *big.Int {
+	return new(big.Int).Quo(wei.Num(), wei.Denom())
 }
 
 func getConstReward(height int64) *big.Int {
@@ -1,7 +1,11 @@
 package payouts
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 
@@ -16,22 +20,108 @@ func TestMain(m *testing.M) {
 func TestCalculateRewards(t *testing.T) {
 	blockReward, _ := new(big.Rat).SetString("5000000000000000000")
 	shares := map[string]int64{"0x0": 1000000, "0x1": 20000, "0x2": 5000, "0x3": 10, "0x4": 1}
-	expectedRewards := map[string]int64{"0x0": 4877996431, "0x1": 97559929, "0x2": 24389982, "0x3": 48780, "0x4": 4878}
+	expectedRewards := map[string]string{
+		"0x0": "4877996431257810891",
+		"0x1": "97559928625156217",
+		"0x2": "24389982156289054",
+		"0x3": "48779964312578",
+		"0x4": "4877996431257",
+	}
 	totalShares := int64(1025011)
 
 	rewards := calculateRewardsForShares(shares, totalShares, blockReward)
-	expectedTotalAmount := int64(5000000000)
+	// Fractional Wei is truncated for each miner
+	expectedTotalAmount := "4999999999999999997"
 
-	totalAmount := int64(0)
+	totalAmount := new(big.Int)
 	for login, amount := range rewards {
-		totalAmount += amount
+		totalAmount.Add(totalAmount, amount)
 
-		if expectedRewards[login] != amount {
+		if expectedRewards[login] != amount.String() {
 			t.Errorf("Amount for %v must be equal to %v vs %v", login, expectedRewards[login], amount)
 		}
 	}
-	if totalAmount != expectedTotalAmount {
-		t.Errorf("Total reward must be equal to block reward in Shannon: %v vs %v", expectedTotalAmount, totalAmount)
+	if totalAmount.String() != expectedTotalAmount {
+		t.Errorf("Total reward must be equal to block reward in Wei: %v vs %v", expectedTotalAmount, totalAmount)
+	}
+}
+
+func TestCalculateTokenRewards(t *testing.T) {
+	backend := storage.NewMemoryClient("test")
+	backend.WriteShare("0x0", "0", nil, nil, []string{"0x1", "0x0", "0x0"}, 3, 100, 0)
+	backend.WriteBlock("0x1", "0", nil, nil, []string{"0x2", "0x0", "0x0"}, 1, 1000, 100, 0)
+	candidates, _ := backend.GetCandidates(100)
+	block := candidates[0]
+	block.Reward = big.NewInt(4e18)
+	block.ExtraReward = big.NewInt(1e18)
+	block.TokenRewards = map[string]*big.Int{"QI": big.NewInt(8e18)}
+
+	u := &BlockUnlocker{config: &UnlockerConfig{PoolFee: 25}, backend: backend}
+	revenue, _, _, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revenue.Cmp(new(big.Rat).SetInt64(5e18)) != 0 {
+		t.Errorf("Revenue of default token must include tx fees, got %v", revenue)
+	}
+	if rewards["QKC"]["0x0"].String() != "2250000000000000000" || rewards["QKC"]["0x1"].String() != "750000000000000000" {
+		t.Errorf("Invalid QKC rewards %v", rewards["QKC"])
+	}
+	if rewards["QI"]["0x0"].String() != "4500000000000000000" || rewards["QI"]["0x1"].String() != "1500000000000000000" {
+		t.Errorf("Invalid QI rewards %v", rewards["QI"])
+	}
+}
+
+func TestFilterRootConfirmed(t *testing.T) {
+	backend := storage.NewMemoryClient("test")
+	backend.WriteRootBlock(&storage.RootIndex{Height: 10, Hash: "0xa", MinorHeight: 100}, []string{"0x1"}, 100)
+	backend.WriteRootBlock(&storage.RootIndex{Height: 20, Hash: "0xb", MinorHeight: 110}, []string{"0x2"}, 100)
+	index := &storage.RootIndex{Height: 29, Hash: "0xc", MinorHeight: 120}
+	blocks := []*storage.BlockData{{Height: 100, Hash: "0x1"}, {Height: 110, Hash: "0x2"}, {Height: 120, Hash: "0x3"}}
+
+	u := &BlockUnlocker{config: &UnlockerConfig{}, backend: backend}
+	confirmed, err := u.filterRootConfirmed(blocks, index, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmed) != 1 || confirmed[0].Hash != "0x1" || confirmed[0].RootHeight != 10 || confirmed[0].RootConfirmations != 20 {
+		t.Errorf("Only block with 20 root confirmations must pass, got %v", confirmed)
+	}
+	if blocks[1].RootConfirmations != 10 || blocks[2].RootHeight != 0 {
+		t.Errorf("Invalid root confirmations %v, %v", blocks[1], blocks[2])
+	}
+}
+
+func TestRewindRootIndex(t *testing.T) {
+	backend := storage.NewMemoryClient("test")
+	for height, hash := range []string{"0xa0", "0xa1", "0xa2", "0xa3", "0xa4"} {
+		index := &storage.RootIndex{Height: int64(height), Hash: hash, MinorHeight: int64(100 + height)}
+		backend.WriteRootBlock(index, []string{fmt.Sprintf("0x%x", 100+height)}, 100)
+	}
+
+	// Node replaced root blocks above 1, deeper than a single step back
+	node := []string{"0xa0", "0xa1", "0xb2", "0xb3", "0xb4", "0xb5"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []string `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var height int
+		fmt.Sscanf(req.Params[0], "0x%x", &height)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": map[string]string{"hash": node[height]}})
+	}))
+	defer server.Close()
+
+	u := &BlockUnlocker{config: &UnlockerConfig{}, backend: backend, rpc: rpc.NewRPCClient("test", server.URL, "1s")}
+	index, err := u.rewindRootIndex(&storage.RootIndex{Height: 4, Hash: "0xa4", MinorHeight: 104})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Height != 1 || index.Hash != "0xa1" || index.MinorHeight != 101 {
+		t.Errorf("Index must be rewound to the last common root block, got %v", index)
+	}
+	if confirmations, _ := backend.GetRootConfirmations([]string{"0x65", "0x66"}); len(confirmations) != 1 {
+		t.Errorf("Confirmations by replaced root blocks must be dropped, got %v", confirmations)
 	}
 }
 
@@ -53,95 +143,32 @@ func TestChargeFee(t *testing.T) {
 	}
 }
 
-func TestWeiToShannonInt64(t *testing.T) {
+func TestRatToWei(t *testing.T) {
 	wei, _ := new(big.Rat).SetString("1000000000000000000")
 	origWei, _ := new(big.Rat).SetString("1000000000000000000")
-	shannon := int64(1000000000)
 
-	if weiToShannonInt64(wei) != shannon {
-		t.Error("Must convert to Shannon")
+	if ratToWei(wei).String() != "1000000000000000000" {
+		t.Error("Must convert to Wei")
 	}
 	if wei.Cmp(origWei) != 0 {
 		t.Error("Must charge original value")
 	}
-}
-
-func TestGetUncleReward(t *testing.T) {
-	rewards := make(map[int64]string)
-	expectedRewards := map[int64]string{
-		1: "4375000000000000000",
-		2: "3750000000000000000",
-		3: "3125000000000000000",
-		4: "2500000000000000000",
-		5: "1875000000000000000",
-		6: "1250000000000000000",
-		7: "625000000000000000",
-	}
-	for i := int64(1); i < 8; i++ {
-		rewards[i] = getUncleReward(1, i+1).String()
-	}
-	for i, reward := range rewards {
-		if expectedRewards[i] != rewards[i] {
-			t.Errorf("Incorrect uncle reward for %v, expected %v vs %v", i, expectedRewards[i], reward)
-		}
-	}
-}
-
-func TestGetByzantiumUncleReward(t *testing.T) {
-	rewards := make(map[int64]string)
-	expectedRewards := map[int64]string{
-		1: "2625000000000000000",
-		2: "2250000000000000000",
-		3: "1875000000000000000",
-		4: "1500000000000000000",
-		5: "1125000000000000000",
-		6: "750000000000000000",
-		7: "375000000000000000",
-	}
-	for i := int64(1); i < 8; i++ {
-		rewards[i] = getUncleReward(byzantiumHardForkHeight, byzantiumHardForkHeight+i).String()
-	}
-	for i, reward := range rewards {
-		if expectedRewards[i] != rewards[i] {
-			t.Errorf("Incorrect uncle reward for %v, expected %v vs %v", i, expectedRewards[i], reward)
-		}
-	}
-}
-
-func TestGetRewardForUngle(t *testing.T) {
-	reward := getRewardForUncle(1).String()
-	expectedReward := "156250000000000000"
-	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", 1, expectedReward, reward)
-	}
-}
-
-func TestGetByzantiumRewardForUngle(t *testing.T) {
-	reward := getRewardForUncle(byzantiumHardForkHeight).String()
-	expectedReward := "93750000000000000"
-	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", byzantiumHardForkHeight, expectedReward, reward)
+	if ratToWei(big.NewRat(19, 10)).Int64() != 1 {
+		t.Error("Must truncate fractional Wei")
 	}
 }
 
 func TestMatchCandidate(t *testing.T) {
 	gethBlock := &rpc.GetBlockReply{Hash: "0x12345A", Nonce: "0x1A"}
-	parityBlock := &rpc.GetBlockReply{Hash: "0x12345A", SealFields: []string{"0x0A", "0x1A"}}
 	candidate := &storage.BlockData{Nonce: "0x1a"}
 	orphan := &storage.BlockData{Nonce: "0x1abc"}
 
 	if !matchCandidate(gethBlock, candidate) {
 		t.Error("Must match with nonce")
 	}
-	if !matchCandidate(parityBlock, candidate) {
-		t.Error("Must match with seal fields")
-	}
 	if matchCandidate(gethBlock, orphan) {
 		t.Error("Must not match with orphan with nonce")
 	}
-	if matchCandidate(parityBlock, orphan) {
-		t.Error("Must not match orphan with seal fields")
-	}
 
 	block := &rpc.GetBlockReply{Hash: "0x12345A"}
 	immature := &storage.BlockData{Hash: "0x12345a", Nonce: "0x0"}
@@ -61,10 +61,10 @@ type PolicyServer struct {
 	timeout    int64
 	blacklist  []string
 	whitelist  []string
-	storage    *storage.RedisClient
+	storage    storage.PolicyStorage
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
+func Start(cfg *Config, storage storage.PolicyStorage) *PolicyServer {
 	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
@@ -10,7 +10,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 
 	"github.com/sammy007/open-ethereum-pool/rpc"
 	//"github.com/sammy007/open-ethereum-pool/util"
@@ -27,14 +26,19 @@ var pow256 = math.BigPow(2, 256)
 
 const maxBacklog = 3
 
+// Jobs of a session accepted for submission
+const maxJobs = 16
+
 type heightDiffPair struct {
 	diff   *big.Int
 	height uint64
+	seq    uint64
 }
 
 type BlockTemplate struct {
 	sync.RWMutex
 	Header               string
+	JobId                string
 	Seed                 string
 	Target               string
 	Difficulty           *big.Int
@@ -44,6 +48,16 @@ type BlockTemplate struct {
 	headers              map[string]heightDiffPair
 }
 
+// Returns header of a job still in backlog
+func (t *BlockTemplate) jobHeader(jobId string) (string, bool) {
+	for k, v := range t.headers {
+		if strconv.FormatUint(v.seq, 16) == jobId {
+			return k, true
+		}
+	}
+	return "", false
+}
+
 type Block struct {
 	difficulty  *big.Int
 	hashNoNonce common.Hash
@@ -59,74 +73,85 @@ func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
 func (s *ProxyServer) fetchBlockTemplate() {
+	if s.isStopping() {
+		return
+	}
 	rpc := s.rpc()
-	count := 0
-	//GetWork for all miners seperately
-	for m, _ := range s.sessions {
-		go func(cs *Session) {
-			s.sessionsMu.Lock()
-			s.updateMap[cs.login] = false
-			s.sessionsMu.Unlock()
-			reply, err := rpc.GetWorkWithID(s.config.Proxy.Stratum.ShardId, cs.login)
-			if err != nil {
-				log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
-				return
-			}
-			// No need to update, we have fresh job
-			t := s.currentBlockTemplateWithId(cs.login)
-			if t == nil {
-				var inital_atomic atomic.Value
-				s.minerBlockTemplateMap[cs.login] = inital_atomic
-			}
-			if t != nil && t.Header == reply[0] {
-				return
-			}
-			diff_template_seperate := DiffHexToDiff(reply[2])
-			height_temp_seperate := HexToInt64(reply[1])
-			seed_seperate := seedHash(height_temp_seperate)
-			guardian_diff_seperate := diff_template_seperate
-			if len(reply) == 4 {
-				guardian_diff_seperate = new(big.Int).Div(diff_template_seperate, new(big.Int).SetInt64(10000))
-			}
-			// Seed equals to hex string Height
-			nTemplate := BlockTemplate{
-				Header:     reply[0],
-				Seed:       fmt.Sprintf("0x%x", seed_seperate),
-				Target:     GetTargetHexFromDiff(guardian_diff_seperate),
-				Height:     height_temp_seperate,
-				Difficulty: guardian_diff_seperate,
-				//Difficulty:           big.NewInt(diff),
-				GetPendingBlockCache: nil,
-				headers:              make(map[string]heightDiffPair),
-			}
-			// Copy job backlog and add current one
-			nTemplate.headers[reply[0]] = heightDiffPair{
-				diff:   guardian_diff_seperate,
-				height: HexToInt64(reply[1]),
-			}
-			if t != nil {
-				for k, v := range t.headers {
-					//if v.height > height-maxBacklog {
-					nTemplate.headers[k] = v
-					//}
-				}
-			}
-			s.sessionsMu.Lock()
-			atomic_temp := s.minerBlockTemplateMap[cs.login]
-			atomic_temp.Store(&nTemplate)
-			s.minerBlockTemplateMap[cs.login] = atomic_temp
-			s.updateMap[cs.login] = true
-			s.sessionsMu.Unlock()
-			count++
-			if t != nil && t.Height > s.Height {
-				s.Height = t.Height
-				s.Difficulty = t.Difficulty
-			}
-			if s.config.Proxy.Stratum.Enabled {
-				go s.broadcastNewJobs()
+	// Work depends on coinbase only, it's fetched once per miner and shared by all of its sessions
+	logins := make(map[string][]*Session)
+	for _, cs := range append(s.activeSessions(), s.activeHttpSessions()...) {
+		logins[cs.login] = append(logins[cs.login], cs)
+	}
+	for login, sessions := range logins {
+		go s.fetchLoginTemplate(rpc, login, sessions)
+	}
+}
+
+func (s *ProxyServer) fetchSessionTemplate(client *rpc.RPCClient, cs *Session) {
+	s.fetchLoginTemplate(client, cs.login, []*Session{cs})
+}
+
+func (s *ProxyServer) fetchLoginTemplate(client *rpc.RPCClient, login string, sessions []*Session) {
+	reply, err := client.GetWorkWithID(s.config.Proxy.Stratum.ShardId, login)
+	if err != nil {
+		log.Printf("Error while refreshing block template on %s: %s", client.Name, err)
+		return
+	}
+	for _, cs := range sessions {
+		s.updateSessionTemplate(cs, reply)
+	}
+}
+
+// Makes fetched work a new job of session, keeping a backlog of its recent jobs
+func (s *ProxyServer) updateSessionTemplate(cs *Session, reply []string) {
+	cs.templateMu.Lock()
+	t := cs.currentTemplate()
+	// No need to update, we have fresh job
+	if t != nil && t.Header == reply[0] {
+		cs.templateMu.Unlock()
+		return
+	}
+	diff := DiffHexToDiff(reply[2])
+	height := HexToInt64(reply[1])
+	if len(reply) == 4 {
+		diff = new(big.Int).Div(diff, new(big.Int).SetInt64(10000))
+	}
+	cs.jobSeq++
+	// Seed equals to hex string Height
+	nTemplate := BlockTemplate{
+		Header:               reply[0],
+		JobId:                strconv.FormatUint(cs.jobSeq, 16),
+		Seed:                 fmt.Sprintf("0x%x", seedHash(height)),
+		Target:               GetTargetHexFromDiff(diff),
+		Height:               height,
+		Difficulty:           diff,
+		GetPendingBlockCache: nil,
+		headers:              make(map[string]heightDiffPair),
+	}
+	// Copy job backlog and add current one
+	nTemplate.headers[reply[0]] = heightDiffPair{
+		diff:   diff,
+		height: height,
+		seq:    cs.jobSeq,
+	}
+	if t != nil {
+		for k, v := range t.headers {
+			if v.height+maxBacklog > height && v.seq+maxJobs > cs.jobSeq {
+				nTemplate.headers[k] = v
 			}
+		}
+	}
+	cs.template.Store(&nTemplate)
+	// Wake up long-polling requests
+	if cs.jobNotify != nil {
+		close(cs.jobNotify)
+		cs.jobNotify = nil
+	}
+	cs.templateMu.Unlock()
 
-		}(m)
+	s.updateNetworkState(height, diff)
+	if cs.isStratum() {
+		s.notifySession(cs, &nTemplate)
 	}
 }
 
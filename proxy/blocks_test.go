@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/rpc"
+)
+
+func TestFetchBlockTemplatePerLogin(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"id":0,"result":["0x1234","0x10","0x100"]}`))
+	}))
+	defer server.Close()
+
+	s := &ProxyServer{config: &Config{}, upstreams: []*rpc.RPCClient{rpc.NewRPCClient("test", server.URL, "1s")}}
+	s.sessions = make(map[*Session]struct{})
+	s.httpSessions = make(map[string]*Session)
+	sessions := []*Session{{login: "0xa"}, {login: "0xa"}, {login: "0xb"}}
+	for _, cs := range sessions {
+		s.sessions[cs] = struct{}{}
+	}
+
+	s.fetchBlockTemplate()
+	deadline := time.Now().Add(time.Second)
+	for _, cs := range sessions {
+		for cs.currentTemplate() == nil && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if job := cs.currentTemplate(); job == nil || job.Header != "0x1234" {
+			t.Fatalf("Session of %v must get a job", cs.login)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Work must be fetched once per login, got %v requests", n)
+	}
+}
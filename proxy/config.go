@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"log"
+
 	"github.com/sammy007/open-ethereum-pool/api"
 	"github.com/sammy007/open-ethereum-pool/payouts"
 	"github.com/sammy007/open-ethereum-pool/policy"
 	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 type Config struct {
@@ -13,11 +16,15 @@ type Config struct {
 	Api                   api.ApiConfig `json:"api"`
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	// Serve several shards in one process, see ShardConfigs
+	Shards []Shard `json:"shards"`
 
 	Threads int `json:"threads"`
 
 	Coin  string         `json:"coin"`
 	Redis storage.Config `json:"redis"`
+	// "redis" or "memory", the latter keeps nothing across restarts and is for development only
+	Storage string `json:"storage"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
@@ -26,6 +33,9 @@ type Config struct {
 	NewrelicKey     string `json:"newrelicKey"`
 	NewrelicVerbose bool   `json:"newrelicVerbose"`
 	NewrelicEnabled bool   `json:"newrelicEnabled"`
+
+	// Deadline for graceful shutdown on SIGINT or SIGTERM
+	ShutdownTimeout string `json:"shutdownTimeout"`
 }
 
 type Proxy struct {
@@ -38,9 +48,17 @@ type Proxy struct {
 	Difficulty           int64  `json:"difficulty"`
 	StateUpdateInterval  string `json:"stateUpdateInterval"`
 	HashrateExpiration   string `json:"hashrateExpiration"`
+	// Drop jobs of HTTP getwork miner after this period without requests
+	HttpIdleTimeout string `json:"httpIdleTimeout"`
+	// Hold getwork with a known header until a new job or timeout, empty disables long-polling
+	LongPollTimeout string `json:"longPollTimeout"`
 
 	Policy policy.Config `json:"policy"`
 
+	VarDiff VarDiff `json:"varDiff"`
+
+	NewWork NewWork `json:"newWork"`
+
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 	ByteCode string  `json:"byteCode"`
@@ -48,6 +66,8 @@ type Proxy struct {
 	Fee int64 `json:"fee"`
 
 	Stratum Stratum `json:"stratum"`
+	// Additional stratum listeners, e.g. a solo one
+	StratumListeners []Stratum `json:"stratumListeners"`
 }
 
 type Stratum struct {
@@ -56,6 +76,17 @@ type Stratum struct {
 	Timeout string `json:"timeout"`
 	MaxConn int    `json:"maxConn"`
 	ShardId string `json:"shardId"`
+	// Miners of solo listener get whole reward of blocks they found
+	Solo bool `json:"solo"`
+	// Extra TLS encrypted listener with the same settings
+	TLS StratumTLS `json:"tls"`
+}
+
+type StratumTLS struct {
+	Enabled  bool   `json:"enabled"`
+	Listen   string `json:"listen"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 type Upstream struct {
@@ -63,3 +94,47 @@ type Upstream struct {
 	Url     string `json:"url"`
 	Timeout string `json:"timeout"`
 }
+
+type Shard struct {
+	ShardId    string `json:"shardId"`
+	Listen     string `json:"listen"`
+	Difficulty int64  `json:"difficulty"`
+	// HTTP getwork address, the first shard falls back to proxy "listen", others serve stratum only if not set
+	HttpListen string `json:"httpListen"`
+}
+
+// Returns config for every shard served by this process, the config itself if no shards are listed.
+// Shard overrides stratum shard id, listen addresses and difficulty as well as unlocker and payouts shard.
+// TLS and additional stratum listeners are kept on the first shard only.
+func (c *Config) ShardConfigs() []*Config {
+	if len(c.Shards) == 0 {
+		return []*Config{c}
+	}
+	configs := make([]*Config, len(c.Shards))
+	for i, shard := range c.Shards {
+		sc := *c
+		sc.Shards = nil
+		sc.Proxy.Stratum.ShardId = shard.ShardId
+		sc.Proxy.Stratum.Listen = shard.Listen
+		if i > 0 || len(shard.HttpListen) > 0 {
+			sc.Proxy.Listen = shard.HttpListen
+		}
+		if shard.Difficulty > 0 {
+			sc.Proxy.Difficulty = shard.Difficulty
+		}
+		if i > 0 {
+			sc.Proxy.Stratum.TLS.Enabled = false
+			sc.Proxy.StratumListeners = nil
+		}
+		sc.BlockUnlocker.ShardId = shard.ShardId
+		sc.Payouts.ShardId = shard.ShardId
+		key, err := util.FullShardKey(shard.ShardId)
+		if err != nil {
+			log.Fatalf("Invalid shard config: %v", err)
+		}
+		sc.Payouts.FromFullShardKey = key
+		sc.Payouts.ToFullShardKey = key
+		configs[i] = &sc
+	}
+	return configs
+}
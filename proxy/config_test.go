@@ -0,0 +1,23 @@
+package proxy
+
+import "testing"
+
+func TestShardConfigs(t *testing.T) {
+	cfg := &Config{Shards: []Shard{
+		{ShardId: "0x1", Listen: "0.0.0.0:8008"},
+		{ShardId: "0x10001", Listen: "0.0.0.0:8018", HttpListen: "0.0.0.0:8898"},
+		{ShardId: "0x10002", Listen: "0.0.0.0:8028"},
+	}}
+	cfg.Proxy.Listen = "0.0.0.0:8888"
+
+	configs := cfg.ShardConfigs()
+	if len(configs) != 3 {
+		t.Fatalf("Invalid shard configs %v", configs)
+	}
+	if configs[0].Proxy.Listen != "0.0.0.0:8888" || configs[1].Proxy.Listen != "0.0.0.0:8898" || configs[2].Proxy.Listen != "" {
+		t.Errorf("Invalid HTTP listen addresses %v, %v, %v", configs[0].Proxy.Listen, configs[1].Proxy.Listen, configs[2].Proxy.Listen)
+	}
+	if configs[1].Proxy.Stratum.ShardId != "0x10001" || configs[1].Payouts.FromFullShardKey != "0x00010000" {
+		t.Errorf("Invalid shard config %+v", configs[1].Proxy.Stratum)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+const defaultHttpIdleTimeout = "10m"
+
+// HTTP getwork miners have no connection, their job backlog is kept per login until idle timeout
+func (s *ProxyServer) httpSession(login, ip string) *Session {
+	s.httpSessionsMu.Lock()
+	defer s.httpSessionsMu.Unlock()
+
+	cs, ok := s.httpSessions[login]
+	if !ok {
+		cs = &Session{ip: ip, login: login}
+		s.httpSessions[login] = cs
+		log.Printf("HTTP miner connected %v@%v", login, ip)
+	}
+	atomic.StoreInt64(&cs.lastSeen, util.MakeTimestamp())
+	return cs
+}
+
+func (s *ProxyServer) activeHttpSessions() []*Session {
+	s.httpSessionsMu.Lock()
+	defer s.httpSessionsMu.Unlock()
+
+	idle := util.MakeTimestamp() - int64(s.httpIdleTimeout/time.Millisecond)
+	sessions := make([]*Session, 0, len(s.httpSessions))
+	for login, cs := range s.httpSessions {
+		if atomic.LoadInt64(&cs.lastSeen) < idle {
+			delete(s.httpSessions, login)
+			log.Printf("HTTP miner %v@%v is idle, dropping its jobs", login, cs.ip)
+			continue
+		}
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
+
+func (s *ProxyServer) handleHttpGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
+	// First request of a miner, fetch its job right away
+	if cs.currentTemplate() == nil {
+		s.fetchSessionTemplate(s.rpc(), cs)
+	}
+	return s.handleGetWorkRPC(cs)
+}
+
+// Blocks while the miner's job is still the one it knows about
+func (s *ProxyServer) waitNewJob(cs *Session, header string, cancel <-chan struct{}) {
+	cs.templateMu.Lock()
+	t := cs.currentTemplate()
+	if t == nil || t.Header != header {
+		cs.templateMu.Unlock()
+		return
+	}
+	if cs.jobNotify == nil {
+		cs.jobNotify = make(chan struct{})
+	}
+	notify := cs.jobNotify
+	cs.templateMu.Unlock()
+
+	timer := time.NewTimer(s.longPollTimeout)
+	defer timer.Stop()
+	select {
+	case <-notify:
+	case <-timer.C:
+	case <-cancel:
+	}
+}
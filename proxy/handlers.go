@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"github.com/sammy007/open-ethereum-pool/rpc"
+	"github.com/sammy007/open-ethereum-pool/storage"
 	"github.com/sammy007/open-ethereum-pool/util"
 	"log"
 	"regexp"
@@ -20,10 +21,13 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	login := strings.ToLower(params[0])
+	login, worker, ok := parseLogin(params, id)
 	if !util.IsValidHexAddress(login) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid login"}
 	}
+	if !ok {
+		return false, &ErrorReply{Code: -1, Message: "Invalid worker name"}
+	}
 	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
@@ -43,17 +47,36 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 		return false, &ErrorReply{Code: -1, Message: "Invalid smart contract pool fee"}
 	}
 	cs.login = login
+	cs.worker = worker
 	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	log.Printf("Stratum miner connected %v.%v@%v", login, worker, cs.ip)
 	return true, nil
 }
 
+// Takes worker name from "address.worker" login, "worker" request field or second param, in this order.
+// The second param is usually a password, so it's only used if it looks like a worker name.
+func parseLogin(params []string, id string) (string, string, bool) {
+	login := strings.ToLower(params[0])
+	worker := id
+	if i := strings.IndexAny(login, "./"); i >= 0 {
+		login, worker = login[:i], params[0][i+1:]
+	}
+	if len(worker) == 0 && len(params) > 1 && params[1] != "x" && workerPattern.MatchString(params[1]) {
+		worker = params[1]
+	}
+	if len(worker) == 0 {
+		return login, "0", true
+	}
+	return login, worker, workerPattern.MatchString(worker)
+}
+
 func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
-	t := s.currentBlockTemplateWithId(cs.login)
+	t := cs.currentTemplate()
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	return []string{t.Header, t.Seed, s.diff}, nil
+	_, target := cs.difficulty(s)
+	return []string{t.Header, t.Seed, target}, nil
 }
 
 // Stratum
@@ -65,42 +88,54 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 	if !ok {
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
-	return s.handleSubmitRPC(cs, cs.login, id, params)
+	// Worker name given on login unless submit carries its own
+	if len(id) == 0 {
+		id = cs.worker
+	}
+	return s.handleSubmitRPC(cs, cs.ip, cs.login, id, params)
 }
 
-func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
+// Policy applies to ip of the request, HTTP session of a login is shared by all its rigs
+func (s *ProxyServer) handleSubmitRPC(cs *Session, ip, login, id string, params []string) (bool, *ErrorReply) {
 	if !workerPattern.MatchString(id) {
 		id = "0"
 	}
 	if len(params) != 3 {
-		s.policy.ApplyMalformedPolicy(cs.ip)
-		log.Printf("Malformed params from %s@%s %v", login, cs.ip, params)
+		s.policy.ApplyMalformedPolicy(ip)
+		log.Printf("Malformed params from %s@%s %v", login, ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
 	if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
-		s.policy.ApplyMalformedPolicy(cs.ip)
-		log.Printf("Malformed PoW result from %s@%s %v", login, cs.ip, params)
+		s.policy.ApplyMalformedPolicy(ip)
+		log.Printf("Malformed PoW result from %s@%s %v", login, ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
-	block := s.currentBlockTemplateWithId(login)
-	exist, validShare := s.processShare(login, id, cs.ip, block, params)
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	if !s.beginShare() {
+		return false, &ErrorReply{Code: -1, Message: "Pool is shutting down"}
+	}
+	block := cs.currentTemplate()
+	status := s.processShare(cs, ip, login, id, block, params)
+	s.endShare()
+	s.writeShareStat(login, id, status)
+	exist, validShare := status == storage.ShareDuplicate, status == storage.ShareAccepted
+	ok := s.policy.ApplySharePolicy(ip, validShare)
 
 	if exist {
-		log.Printf("Duplicate share from %s@%s %v", login, cs.ip, params)
+		log.Printf("Duplicate share from %s@%s %v", login, ip, params)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
 	}
 
 	if !validShare {
-		log.Printf("Invalid share from %s@%s", login, cs.ip)
+		log.Printf("Invalid share from %s@%s", login, ip)
 		// Bad shares limit reached, return error and close
 		if !ok {
 			return false, &ErrorReply{Code: 23, Message: "Invalid share"}
 		}
 		return false, nil
 	}
-	log.Printf("Valid share from %s@%s", login, cs.ip)
+	log.Printf("Valid share from %s@%s", login, ip)
+	cs.countShare()
 
 	if !ok {
 		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
@@ -108,6 +143,40 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	return true, nil
 }
 
+func (s *ProxyServer) handleSubmitHashrateRPC(cs *Session, ip, login, id string, params []string) bool {
+	if len(login) == 0 || len(params) == 0 {
+		return false
+	}
+	if len(id) == 0 {
+		id = cs.worker
+	}
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	hashrate, err := strconv.ParseInt(strings.TrimPrefix(params[0], "0x"), 16, 64)
+	if err != nil || hashrate < 0 {
+		s.policy.ApplyMalformedPolicy(ip)
+		log.Printf("Malformed hashrate from %s@%s %v", login, ip, params)
+		return false
+	}
+	clientId := ""
+	if len(params) > 1 && hashPattern.MatchString(params[1]) {
+		clientId = params[1]
+	}
+	err = s.backend.WriteReportedHashrate(login, id, hashrate, clientId, s.hashrateExpiration)
+	if err != nil {
+		log.Printf("Failed to write reported hashrate of %s: %v", login, err)
+	}
+	return true
+}
+
+func (s *ProxyServer) writeShareStat(login, id, status string) {
+	err := s.backend.WriteShareStat(login, id, status)
+	if err != nil {
+		log.Printf("Failed to write share stats of %s: %v", login, err)
+	}
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := s.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"math/big"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Ethash light verification in Go, used to compute mix digest for EthereumStratum/1.0.0
+// miners who don't submit it.
+const (
+	hashBytes          = 64
+	hashWords          = 16
+	mixBytes           = 128
+	cacheInitBytes     = 1 << 24
+	cacheGrowthBytes   = 1 << 17
+	datasetInitBytes   = 1 << 30
+	datasetGrowthBytes = 1 << 23
+	cacheRounds        = 3
+	datasetParents     = 256
+	loopAccesses       = 64
+	maxCachedEpochs    = 2
+)
+
+type lightCache struct {
+	epoch   uint64
+	cache   []uint32
+	dataset uint64
+	// Cache is generated once by the first share of epoch, outside of the lock
+	once sync.Once
+}
+
+func (c *lightCache) generate() {
+	c.dataset = datasetSize(c.epoch)
+	c.cache = make([]uint32, cacheSize(c.epoch)/4)
+	generateCache(c.cache, seedHash(c.epoch*epochLength))
+}
+
+type lightCaches struct {
+	sync.Mutex
+	caches map[uint64]*lightCache
+}
+
+var ethashLight = &lightCaches{caches: make(map[uint64]*lightCache)}
+
+// Returns mix digest and result hash for a header and nonce at given block height
+func (l *lightCaches) compute(height uint64, hashNoNonce []byte, nonce uint64) ([]byte, []byte) {
+	c := l.get(height / epochLength)
+	c.once.Do(c.generate)
+	return hashimotoLight(c.dataset, c.cache, hashNoNonce, nonce)
+}
+
+// Shares of other epochs don't wait for cache being generated
+func (l *lightCaches) get(epoch uint64) *lightCache {
+	l.Lock()
+	defer l.Unlock()
+	if c, ok := l.caches[epoch]; ok {
+		return c
+	}
+	// Drop the oldest epoch, miners rarely work on more than two of them
+	if len(l.caches) >= maxCachedEpochs {
+		oldest := epoch
+		for e := range l.caches {
+			if e < oldest {
+				oldest = e
+			}
+		}
+		delete(l.caches, oldest)
+	}
+	c := &lightCache{epoch: epoch}
+	l.caches[epoch] = c
+	return c
+}
+
+func cacheSize(epoch uint64) uint64 {
+	size := cacheInitBytes + cacheGrowthBytes*epoch - hashBytes
+	for !new(big.Int).SetUint64(size / hashBytes).ProbablyPrime(1) {
+		size -= 2 * hashBytes
+	}
+	return size
+}
+
+func datasetSize(epoch uint64) uint64 {
+	size := datasetInitBytes + datasetGrowthBytes*epoch - mixBytes
+	for !new(big.Int).SetUint64(size / mixBytes).ProbablyPrime(1) {
+		size -= 2 * mixBytes
+	}
+	return size
+}
+
+func fnv(a, b uint32) uint32 {
+	return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+	for i := 0; i < len(mix); i++ {
+		mix[i] = mix[i]*0x01000193 ^ data[i]
+	}
+}
+
+func generateCache(dest []uint32, seed []byte) {
+	keccak512 := makeHasher(sha3.NewLegacyKeccak512())
+	cache := make([]byte, len(dest)*4)
+	rows := len(cache) / hashBytes
+
+	keccak512(cache, seed)
+	for offset := hashBytes; offset < len(cache); offset += hashBytes {
+		keccak512(cache[offset:], cache[offset-hashBytes:offset])
+	}
+	temp := make([]byte, hashBytes)
+	for i := 0; i < cacheRounds; i++ {
+		for j := 0; j < rows; j++ {
+			srcOff := ((j - 1 + rows) % rows) * hashBytes
+			dstOff := j * hashBytes
+			xorOff := int(binary.LittleEndian.Uint32(cache[dstOff:])%uint32(rows)) * hashBytes
+			for k := 0; k < hashBytes; k++ {
+				temp[k] = cache[srcOff+k] ^ cache[xorOff+k]
+			}
+			keccak512(cache[dstOff:], temp)
+		}
+	}
+	for i := range dest {
+		dest[i] = binary.LittleEndian.Uint32(cache[i*4:])
+	}
+}
+
+func generateDatasetItem(cache []uint32, index uint32, keccak512 hasher) []byte {
+	rows := uint32(len(cache) / hashWords)
+
+	mix := make([]byte, hashBytes)
+	binary.LittleEndian.PutUint32(mix, cache[(index%rows)*hashWords]^index)
+	for i := 1; i < hashWords; i++ {
+		binary.LittleEndian.PutUint32(mix[i*4:], cache[(index%rows)*hashWords+uint32(i)])
+	}
+	keccak512(mix, mix)
+
+	intMix := make([]uint32, hashWords)
+	for i := 0; i < len(intMix); i++ {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	for i := uint32(0); i < datasetParents; i++ {
+		parent := fnv(index^i, intMix[i%16]) % rows
+		fnvHash(intMix, cache[parent*hashWords:])
+	}
+	for i, val := range intMix {
+		binary.LittleEndian.PutUint32(mix[i*4:], val)
+	}
+	keccak512(mix, mix)
+	return mix
+}
+
+func hashimotoLight(size uint64, cache []uint32, hash []byte, nonce uint64) ([]byte, []byte) {
+	keccak512 := makeHasher(sha3.NewLegacyKeccak512())
+	lookup := func(index uint32) []uint32 {
+		item := generateDatasetItem(cache, index, keccak512)
+		data := make([]uint32, hashWords)
+		for i := 0; i < len(data); i++ {
+			data[i] = binary.LittleEndian.Uint32(item[i*4:])
+		}
+		return data
+	}
+
+	rows := uint32(size / mixBytes)
+
+	seed := make([]byte, 40)
+	copy(seed, hash)
+	binary.LittleEndian.PutUint64(seed[32:], nonce)
+	seed = keccak512Sum(seed)
+	seedHead := binary.LittleEndian.Uint32(seed)
+
+	mix := make([]uint32, mixBytes/4)
+	for i := 0; i < len(mix); i++ {
+		mix[i] = binary.LittleEndian.Uint32(seed[i%16*4:])
+	}
+	temp := make([]uint32, len(mix))
+	for i := 0; i < loopAccesses; i++ {
+		parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+		for j := uint32(0); j < mixBytes/hashBytes; j++ {
+			copy(temp[j*hashWords:], lookup(2*parent+j))
+		}
+		fnvHash(mix, temp)
+	}
+	for i := 0; i < len(mix); i += 4 {
+		mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+	}
+	mix = mix[:len(mix)/4]
+
+	digest := make([]byte, 32)
+	for i, val := range mix {
+		binary.LittleEndian.PutUint32(digest[i*4:], val)
+	}
+	h := sha3.NewLegacyKeccak256()
+	h.Write(seed)
+	h.Write(digest)
+	return digest, h.Sum(nil)
+}
+
+func keccak512Sum(data []byte) []byte {
+	h := sha3.NewLegacyKeccak512()
+	h.Write(data)
+	return h.Sum(nil)
+}
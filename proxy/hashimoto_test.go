@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"encoding/hex"
+)
+
+// Test vector of go-ethereum for a tiny cache and dataset
+func TestHashimotoLight(t *testing.T) {
+	cache := make([]uint32, 1024/4)
+	generateCache(cache, make([]byte, 32))
+
+	hash := fromHex("c9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	wantDigest := fromHex("e4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800")
+	wantResult := fromHex("d3539235ee2e6f8db665c0a72169f55b7f6c605712330b778ec3944f0eb5a557")
+
+	digest, result := hashimotoLight(32*1024, cache, hash, 0)
+	if !bytes.Equal(digest, wantDigest) {
+		t.Errorf("Light hashimoto digest mismatch: have %x, want %x", digest, wantDigest)
+	}
+	if !bytes.Equal(result, wantResult) {
+		t.Errorf("Light hashimoto result mismatch: have %x, want %x", result, wantResult)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	if n := cacheSize(0); n != 16776896 {
+		t.Errorf("Invalid cache size for epoch 0: %v", n)
+	}
+	if n := datasetSize(0); n != 1073739904 {
+		t.Errorf("Invalid dataset size for epoch 0: %v", n)
+	}
+}
+
+func TestLightCachesGet(t *testing.T) {
+	l := &lightCaches{caches: make(map[uint64]*lightCache)}
+	// Cache isn't generated while holding the lock
+	c := l.get(1)
+	if c.cache != nil || l.get(1) != c {
+		t.Error("Epoch must be cached once and generated outside of get")
+	}
+	l.get(2)
+	l.get(3)
+	if _, ok := l.caches[1]; ok || len(l.caches) != maxCachedEpochs {
+		t.Errorf("Oldest epoch must be dropped, got %v", l.caches)
+	}
+}
+
+func fromHex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
@@ -8,21 +8,29 @@ import (
 
 	"github.com/ethereum/ethash"
 	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 var ethash_hasher = ethash.New()
 
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
+func (s *ProxyServer) processShare(cs *Session, ip, login, id string, t *BlockTemplate, params []string) string {
+	solo := cs.solo
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
+	shareDiff, _ := cs.difficulty(s)
 
+	if t == nil {
+		log.Printf("Stale share from %v@%v", login, ip)
+		return storage.ShareStale
+	}
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
 		log.Printf("Stale share from %v@%v", login, ip)
-		return false, false
+		return storage.ShareStale
 	}
 
 	share := Block{
@@ -42,7 +50,16 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	}
 
 	if !ethash_hasher.Verify(share) {
-		return false, false
+		// Share for a job sent before vardiff raised the target
+		prevDiff := cs.previousDifficulty(h.seq)
+		if prevDiff == 0 || prevDiff >= shareDiff {
+			return storage.ShareInvalid
+		}
+		share.difficulty = big.NewInt(prevDiff)
+		if !ethash_hasher.Verify(share) {
+			return storage.ShareInvalid
+		}
+		shareDiff = prevDiff
 	}
 	log.Printf("---shard and block diff, height, %v, %v, %v", share.difficulty, block.difficulty, h.height)
 
@@ -52,30 +69,61 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
 		} else if !ok {
 			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
-			return false, false
+			// Node rejects blocks of outdated jobs
+			return storage.ShareStale
 		} else {
 			s.fetchBlockTemplate()
-			balance, _ := s.rpc().GetBalance(login)
-			exist, err := s.backend.WriteBlock(login, id, balance, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			var exist bool
+			var err error
+			balance, credit := s.shareBalance(login, shareDiff, h.diff, solo)
+			if solo {
+				exist, err = s.backend.WriteSoloBlock(login, id, balance, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			} else {
+				exist, err = s.backend.WriteBlock(login, id, balance, credit, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
+			}
 			if exist {
-				return true, false
+				return storage.ShareDuplicate
 			}
 			if err != nil {
 				log.Println("Failed to insert block candidate into backend:", err)
 			} else {
 				log.Printf("Inserted block %v to backend", h.height)
 			}
-			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
+			if solo {
+				log.Printf("Solo block found by miner %v@%v at height %d", login, ip, h.height)
+			} else {
+				log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
+			}
 		}
 	} else {
-		balance, _ := s.rpc().GetBalance(login)
-		exist, err := s.backend.WriteShare(login, id, balance, params, shareDiff, h.height, s.hashrateExpiration)
+		var exist bool
+		var err error
+		balance, credit := s.shareBalance(login, shareDiff, h.diff, solo)
+		// Solo shares are only accounted for hashrate
+		if solo {
+			exist, err = s.backend.WriteSoloShare(login, id, balance, params, shareDiff, h.height, s.hashrateExpiration)
+		} else {
+			exist, err = s.backend.WriteShare(login, id, balance, credit, params, shareDiff, h.height, s.hashrateExpiration)
+		}
 		if exist {
-			return true, false
+			return storage.ShareDuplicate
 		}
 		if err != nil {
 			log.Println("Failed to insert share data into backend:", err)
 		}
 	}
-	return false, true
+	return storage.ShareAccepted
+}
+
+// In PPS mode miner's balance is a pool-side ledger credited per share, otherwise it mirrors on-chain balance.
+// Solo shares are never credited.
+func (s *ProxyServer) shareBalance(login string, shareDiff int64, netDiff *big.Int, solo bool) (*big.Int, *big.Int) {
+	if s.config.BlockUnlocker.IsPPS() {
+		if solo {
+			return nil, nil
+		}
+		return nil, s.ppsCredit(shareDiff, netDiff)
+	}
+	balance, _ := s.rpc().GetBalance(login, s.config.Proxy.Stratum.ShardId, util.DefaultToken)
+	return balance, nil
 }
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// New heads subscription, polling of getWork is kept as a fallback with a longer interval
+type NewWork struct {
+	Enabled          bool   `json:"enabled"`
+	Url              string `json:"url"`
+	FallbackInterval string `json:"fallbackInterval"`
+}
+
+const newWorkReconnectDelay = 5 * time.Second
+
+type subscriptionReq struct {
+	Id      int64       `json:"id"`
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type subscriptionMsg struct {
+	Method string           `json:"method"`
+	Result json.RawMessage  `json:"result"`
+	Error  *json.RawMessage `json:"error"`
+}
+
+func (s *ProxyServer) subscribeNewWork() {
+	url := s.config.Proxy.NewWork.Url
+	for {
+		err := s.listenNewWork(url)
+		atomic.StoreInt32(&s.subscribed, 0)
+		log.Printf("New work subscription to %s lost, polling every %v: %v", url, s.refreshIntv, err)
+		time.Sleep(newWorkReconnectDelay)
+	}
+}
+
+func (s *ProxyServer) listenNewWork(url string) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Node serves subscriptions per shard only, there is no root chain newHeads.
+	// A new root block doesn't invalidate work: minor block on the previous root block is still accepted,
+	// its template referencing the new root block is picked up by the fallback poll.
+	req := subscriptionReq{Id: 1, Version: "2.0", Method: "subscribe", Params: []string{"newHeads", s.config.Proxy.Stratum.ShardId}}
+	err = conn.WriteJSON(&req)
+	if err != nil {
+		return err
+	}
+	var reply subscriptionMsg
+	err = conn.ReadJSON(&reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("subscribe failed: %s", string(*reply.Error))
+	}
+	if len(reply.Result) == 0 {
+		return errors.New("subscribe failed: empty subscription id")
+	}
+	atomic.StoreInt32(&s.subscribed, 1)
+	log.Printf("Subscribed to new heads of shard %s on %s", s.config.Proxy.Stratum.ShardId, url)
+
+	for {
+		var msg subscriptionMsg
+		err = conn.ReadJSON(&msg)
+		if err != nil {
+			return err
+		}
+		if msg.Method == "subscription" {
+			s.fetchBlockTemplate()
+		}
+	}
+}
+
+// Polling is only a fallback while new heads subscription is alive
+func (s *ProxyServer) nextRefresh() time.Duration {
+	if atomic.LoadInt32(&s.subscribed) == 1 {
+		return s.fallbackIntv
+	}
+	return s.refreshIntv
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+)
+
+// EthereumStratum/1.0.0 (NiceHash) protocol, negotiated by mining.subscribe as the first message
+const (
+	esProtocol = "EthereumStratum/1.0.0"
+	// Miners roll the rest of 8 bytes nonce
+	esExtraNonceSize = 3
+	// Difficulty 1 of mining.set_difficulty is 2^32 hashes
+	esDiffDivisor = 4294967296.0
+)
+
+var esNoncePattern = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", 16-esExtraNonceSize*2))
+
+func (s *ProxyServer) allocExtraNonce() string {
+	n := atomic.AddUint32(&s.extraNonce, 1)
+	return fmt.Sprintf("%06x", n&0xffffff)
+}
+
+func (cs *Session) handleESMessage(s *ProxyServer, req *StratumReq) error {
+	switch req.Method {
+	case "mining.subscribe":
+		if len(cs.extraNonce) == 0 {
+			cs.extraNonce = s.allocExtraNonce()
+		}
+		reply := []interface{}{[]string{"mining.notify", cs.extraNonce, esProtocol}, cs.extraNonce}
+		return cs.sendTCPResult(req.Id, reply)
+	case "mining.extranonce.subscribe":
+		return cs.sendTCPResult(req.Id, true)
+	case "mining.authorize":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil || len(params) == 0 {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		err = cs.sendTCPResult(req.Id, reply)
+		if err != nil {
+			return err
+		}
+		return s.pushLoginJob(cs)
+	case "mining.submit":
+		var params []string
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil || len(params) != 3 {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		// Worker is known from mining.authorize
+		reply, errReply := s.handleESSubmitRPC(cs, "", params[1], params[2])
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		err = cs.sendTCPResult(req.Id, reply)
+		if err != nil {
+			return err
+		}
+		if reply && s.retarget(cs) {
+			return s.pushJob(cs)
+		}
+		return nil
+	case "mining.hashrate", "eth_submitHashrate":
+		var params []string
+		json.Unmarshal(req.Params, &params)
+		return cs.sendTCPResult(req.Id, s.handleSubmitHashrateRPC(cs, cs.ip, cs.login, cs.worker, params))
+	default:
+		errReply := s.handleUnknownRPC(cs, req.Method)
+		return cs.sendTCPError(req.Id, errReply)
+	}
+}
+
+// Rebuilds eth_submitWork params from job id and nonce suffix, computing mix digest on the pool side
+func (s *ProxyServer) handleESSubmitRPC(cs *Session, id, jobId, nonceSuffix string) (bool, *ErrorReply) {
+	if !esNoncePattern.MatchString(nonceSuffix) {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed nonce from %s@%s %v", cs.login, cs.ip, nonceSuffix)
+		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
+	}
+	var header string
+	t := cs.currentTemplate()
+	if t != nil {
+		header, _ = t.jobHeader(jobId)
+	}
+	if len(header) == 0 {
+		log.Printf("Stale share from %v@%v", cs.login, cs.ip)
+		s.writeShareStat(cs.login, cs.worker, storage.ShareStale)
+		return false, nil
+	}
+
+	nonceHex := cs.extraNonce + nonceSuffix
+	nonce, _ := strconv.ParseUint(nonceHex, 16, 64)
+	hash, _ := hex.DecodeString(header[2:])
+	mixDigest, _ := ethashLight.compute(t.headers[header].height, hash, nonce)
+
+	params := []string{"0x" + nonceHex, header, "0x" + hex.EncodeToString(mixDigest)}
+	return s.handleTCPSubmitRPC(cs, id, params)
+}
+
+func (cs *Session) pushESJob(block *BlockTemplate, diff int64) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.sentDiff != diff {
+		message := JSONNotifyMessage{Method: "mining.set_difficulty", Params: []float64{float64(diff) / esDiffDivisor}}
+		err := cs.enc.Encode(&message)
+		if err != nil {
+			return err
+		}
+		cs.sentDiff = diff
+	}
+
+	params := []interface{}{block.JobId, strings.TrimPrefix(block.Seed, "0x"), strings.TrimPrefix(block.Header, "0x"), true}
+	message := JSONNotifyMessage{Method: "mining.notify", Params: params}
+	return cs.enc.Encode(&message)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"log"
+	"math/big"
+
+	"github.com/sammy007/open-ethereum-pool/payouts"
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Expected block reward in Wei, FPPS follows average reward of matured blocks
+func (s *ProxyServer) refreshPPSReward() {
+	cfg := &s.config.BlockUnlocker
+	if !cfg.IsPPS() {
+		return
+	}
+	reward := util.String2Big(cfg.PPS.BlockReward)
+	if cfg.PayoutScheme == payouts.SchemeFPPS {
+		avg, err := s.backend.GetAverageReward(cfg.PPSAvgWindow())
+		if err != nil {
+			log.Printf("Failed to get average block reward from backend: %v", err)
+			return
+		}
+		if avg != nil && avg.Sign() > 0 {
+			reward = avg
+		}
+	}
+	s.ppsReward.Store(reward)
+}
+
+// Returns PPS credit for a share in Wei, nil if pool doesn't pay per share
+func (s *ProxyServer) ppsCredit(shareDiff int64, netDiff *big.Int) *big.Int {
+	reward, ok := s.ppsReward.Load().(*big.Int)
+	if !ok || netDiff.Sign() <= 0 {
+		return nil
+	}
+	value := new(big.Rat).SetFrac(new(big.Int).Mul(reward, big.NewInt(shareDiff)), netDiff)
+	value.Mul(value, new(big.Rat).SetFloat64(1-s.config.BlockUnlocker.PoolFee/100))
+	return new(big.Int).Quo(value.Num(), value.Denom())
+}
@@ -36,3 +36,10 @@ type ErrorReply struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
+
+// EthereumStratum/1.0.0 notification
+type JSONNotifyMessage struct {
+	Id     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
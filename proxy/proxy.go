@@ -25,21 +25,40 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
+	backend            storage.Backend
 	diff               string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	retargetIntv       time.Duration
+	refreshIntv        time.Duration
+	fallbackIntv       time.Duration
+	subscribed         int32
+	extraNonce         uint32
 
+	stateMu              sync.RWMutex
 	Difficulty           *big.Int
 	Height               uint64
 
+	// Expected block reward for PPS, *big.Int
+	ppsReward atomic.Value
+
 	// Stratum
 	sessionsMu sync.RWMutex
 	sessions   map[*Session]struct{}
-	timeout    time.Duration
-	minerBlockTemplateMap  map[string]atomic.Value
-	updateMap map[string]bool
+
+	// HTTP getwork miners by login
+	httpSessionsMu  sync.Mutex
+	httpSessions    map[string]*Session
+	httpIdleTimeout time.Duration
+	longPollTimeout time.Duration
+
+	// Graceful shutdown
+	stopping    int32
+	sharesMu    sync.RWMutex
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+	httpServer  *http.Server
 }
 
 type Session struct {
@@ -48,15 +67,42 @@ type Session struct {
 
 	// Stratum
 	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	conn    net.Conn
+	login   string
+	timeout time.Duration
+	solo    bool
+	// Last request of HTTP miner, ms
+	lastSeen int64
+
+	// Current job with a backlog of recent headers, *BlockTemplate
+	templateMu sync.Mutex
+	template   atomic.Value
+	jobSeq     uint64
+	// Closed once template changes
+	jobNotify chan struct{}
+
+	// Vardiff
+	diffMu       sync.Mutex
+	diff         int64
+	prevDiff     int64
+	target       string
+	shares       int64
+	lastRetarget time.Time
+	// Last job sent with previous difficulty and when it stops being accepted
+	prevDiffSeq   uint64
+	prevDiffUntil time.Time
+
+	// EthereumStratum/1.0.0
+	es         bool
+	extraNonce string
+	worker     string
+	sentDiff   int64
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Backend, policy *policy.PolicyServer) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
-	policy := policy.Start(&cfg.Proxy.Policy, backend)
 
 	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
 	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
@@ -64,26 +110,67 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	proxy.Difficulty = new(big.Int)
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
-	proxy.minerBlockTemplateMap = make(map[string]atomic.Value)
-	proxy.updateMap = make(map[string]bool)
 	for i, v := range cfg.Upstream {
 		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
 		log.Printf("Upstream: %s => %s", v.Name, v.Url)
 	}
 	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
+	if cfg.Proxy.VarDiff.Enabled {
+		proxy.retargetIntv = util.MustParseDuration(cfg.Proxy.VarDiff.RetargetInterval)
+		if cfg.Proxy.VarDiff.SharesPerMinute <= 0 {
+			log.Fatal("You must set varDiff sharesPerMinute")
+		}
+		if cfg.Proxy.VarDiff.MinDiff <= 0 {
+			log.Fatal("You must set varDiff minDiff")
+		}
+		if cfg.Proxy.VarDiff.MinDiff > cfg.Proxy.Difficulty {
+			log.Fatalf("varDiff minDiff %v is above shard difficulty %v", cfg.Proxy.VarDiff.MinDiff, cfg.Proxy.Difficulty)
+		}
+		log.Printf("Vardiff enabled, retarget every %v", proxy.retargetIntv)
+	}
+
+	proxy.sessions = make(map[*Session]struct{})
+	proxy.httpSessions = make(map[string]*Session)
+	httpIdleTimeout := cfg.Proxy.HttpIdleTimeout
+	if len(httpIdleTimeout) == 0 {
+		httpIdleTimeout = defaultHttpIdleTimeout
+	}
+	proxy.httpIdleTimeout = util.MustParseDuration(httpIdleTimeout)
+	if len(cfg.Proxy.LongPollTimeout) > 0 {
+		proxy.longPollTimeout = util.MustParseDuration(cfg.Proxy.LongPollTimeout)
+		log.Printf("HTTP getwork long-polling enabled, timeout %v", proxy.longPollTimeout)
+	}
 	if cfg.Proxy.Stratum.Enabled {
-		proxy.sessions = make(map[*Session]struct{})
-		go proxy.ListenTCP()
+		go proxy.ListenTCP(&cfg.Proxy.Stratum)
+	}
+	for i := range cfg.Proxy.StratumListeners {
+		if cfg.Proxy.StratumListeners[i].Enabled {
+			go proxy.ListenTCP(&cfg.Proxy.StratumListeners[i])
+		}
 	}
 
 	proxy.fetchBlockTemplate()
 
+	if cfg.BlockUnlocker.IsPPS() {
+		if util.String2Big(cfg.BlockUnlocker.PPS.BlockReward).Sign() <= 0 {
+			log.Fatalf("PPS blockReward must be set for %v", cfg.BlockUnlocker.PayoutScheme)
+		}
+		proxy.refreshPPSReward()
+		log.Printf("Paying %v for every share", cfg.BlockUnlocker.PayoutScheme)
+	}
+
 	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
-	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
-	refreshTimer := time.NewTimer(refreshIntv)
-	log.Printf("Set block refresh every %v", refreshIntv)
+	proxy.refreshIntv = util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
+	refreshTimer := time.NewTimer(proxy.refreshIntv)
+	log.Printf("Set block refresh every %v", proxy.refreshIntv)
+
+	if cfg.Proxy.NewWork.Enabled {
+		proxy.fallbackIntv = util.MustParseDuration(cfg.Proxy.NewWork.FallbackInterval)
+		log.Printf("Set block refresh every %v while subscribed to new heads", proxy.fallbackIntv)
+		go proxy.subscribeNewWork()
+	}
 
 	checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
 	checkTimer := time.NewTimer(checkIntv)
@@ -96,7 +183,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 			select {
 			case <-refreshTimer.C:
 				proxy.fetchBlockTemplate()
-				refreshTimer.Reset(refreshIntv)
+				refreshTimer.Reset(proxy.nextRefresh())
 			}
 		}
 	}()
@@ -117,7 +204,8 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 			case <-stateUpdateTimer.C:
 				//t := proxy.currentBlockTemplate()
 				//if t != nil {
-					err := backend.WriteNodeState(cfg.Name, proxy.Height, proxy.Difficulty)
+					height, diff := proxy.networkState()
+					err := backend.WriteNodeState(cfg.Name, height, diff)
 					if err != nil {
 						log.Printf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -125,6 +213,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 						proxy.markOk()
 					}
 				//}
+				proxy.refreshPPSReward()
 				stateUpdateTimer.Reset(stateUpdateIntv)
 			}
 		}
@@ -143,8 +232,14 @@ func (s *ProxyServer) Start() {
 		Handler:        r,
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
 	}
+	s.listenersMu.Lock()
+	s.httpServer = srv
+	s.listenersMu.Unlock()
+	if s.isStopping() {
+		return
+	}
 	err := srv.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
 }
@@ -239,10 +334,20 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 		return
 	}
 
+	ms := s.httpSession(login, cs.ip)
+
 	// Handle RPC methods
 	switch req.Method {
 	case "eth_getWork":
-		reply, errReply := s.handleGetWorkRPC(cs)
+		// Long-poll mode, miner passes header hash of its current job
+		var params []string
+		if req.Params != nil {
+			json.Unmarshal(req.Params, &params)
+		}
+		if len(params) > 0 && s.longPollTimeout > 0 {
+			s.waitNewJob(ms, params[0], r.Context().Done())
+		}
+		reply, errReply := s.handleHttpGetWorkRPC(ms)
 		if errReply != nil {
 			cs.sendError(req.Id, errReply)
 			break
@@ -257,7 +362,7 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 				s.policy.ApplyMalformedPolicy(cs.ip)
 				break
 			}
-			reply, errReply := s.handleSubmitRPC(cs, login, vars["id"], params)
+			reply, errReply := s.handleSubmitRPC(ms, cs.ip, login, vars["id"], params)
 			if errReply != nil {
 				cs.sendError(req.Id, errReply)
 				break
@@ -272,7 +377,9 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	//	reply := s.handleGetBlockByNumberRPC()
 	//	cs.sendResult(req.Id, reply)
 	case "eth_submitHashrate":
-		cs.sendResult(req.Id, true)
+		var params []string
+		json.Unmarshal(req.Params, &params)
+		cs.sendResult(req.Id, s.handleSubmitHashrateRPC(ms, cs.ip, login, vars["id"], params))
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		cs.sendError(req.Id, errReply)
@@ -303,19 +410,30 @@ func (s *ProxyServer) currentBlockTemplate() *BlockTemplate {
 	}
 }
 
-func (s *ProxyServer) currentBlockTemplateWithId(login string) *BlockTemplate {
-	t, ok := s.minerBlockTemplateMap[login]
-	if (!ok) {
-		return nil
-	}
-	tt := t.Load()
-	if (tt != nil) {
-		return tt.(*BlockTemplate)
+func (cs *Session) currentTemplate() *BlockTemplate {
+	t := cs.template.Load()
+	if t != nil {
+		return t.(*BlockTemplate)
 	} else {
 		return nil
 	}
 }
 
+func (s *ProxyServer) updateNetworkState(height uint64, diff *big.Int) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if height > s.Height {
+		s.Height = height
+		s.Difficulty = diff
+	}
+}
+
+func (s *ProxyServer) networkState() (uint64, *big.Int) {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+	return s.Height, s.Difficulty
+}
+
 func (s *ProxyServer) markSick() {
 	atomic.AddInt64(&s.failsCount, 1)
 }
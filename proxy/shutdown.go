@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+func (s *ProxyServer) isStopping() bool {
+	return atomic.LoadInt32(&s.stopping) == 1
+}
+
+func (s *ProxyServer) addListener(l net.Listener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// Share is written only if it started before shutdown, Stop waits for it
+func (s *ProxyServer) beginShare() bool {
+	s.sharesMu.RLock()
+	if s.isStopping() {
+		s.sharesMu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (s *ProxyServer) endShare() {
+	s.sharesMu.RUnlock()
+}
+
+// Stops accepting miners and pushing jobs, then waits for shares and blocks being written
+func (s *ProxyServer) Stop(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.stopping, 0, 1) {
+		return
+	}
+	log.Printf("Stopping proxy of shard %v", s.config.Proxy.Stratum.ShardId)
+
+	s.listenersMu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	srv := s.httpServer
+	s.listenersMu.Unlock()
+	if srv != nil {
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Printf("HTTP proxy shutdown: %v", err)
+		}
+	}
+
+	s.sharesMu.Lock()
+	s.sharesMu.Unlock()
+
+	sessions := append(s.activeSessions(), s.activeHttpSessions()...)
+	for _, cs := range sessions {
+		if cs.isStratum() {
+			cs.conn.Close()
+		}
+	}
+	log.Printf("Proxy of shard %v stopped, %v sessions closed", s.config.Proxy.Stratum.ShardId, len(sessions))
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
@@ -16,11 +17,12 @@ const (
 	MaxReqSize = 1024
 )
 
-func (s *ProxyServer) ListenTCP() {
-	timeout := util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
-	s.timeout = timeout
+func (s *ProxyServer) ListenTCP(cfg *Stratum) {
+	if cfg.TLS.Enabled {
+		go s.ListenTLS(cfg)
+	}
 
-	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratum.Listen)
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Listen)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
@@ -30,32 +32,51 @@ func (s *ProxyServer) ListenTCP() {
 	}
 	defer server.Close()
 
-	log.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
+	if cfg.Solo {
+		log.Printf("Solo stratum listening on %s", cfg.Listen)
+	} else {
+		log.Printf("Stratum listening on %s", cfg.Listen)
+	}
+	s.serveTCP(server, cfg, nil)
+}
+
+// Accepts stratum connections, wrapping them into TLS if tlsConfig is given
+func (s *ProxyServer) serveTCP(server *net.TCPListener, cfg *Stratum, tlsConfig *tls.Config) {
+	timeout := util.MustParseDuration(cfg.Timeout)
+	var accept = make(chan int, cfg.MaxConn)
 	n := 0
+	s.addListener(server)
 
 	for {
-		conn, err := server.AcceptTCP()
+		tcpConn, err := server.AcceptTCP()
 		if err != nil {
+			if s.isStopping() {
+				return
+			}
 			continue
 		}
-		conn.SetKeepAlive(true)
+		tcpConn.SetKeepAlive(true)
 
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		ip, _, _ := net.SplitHostPort(tcpConn.RemoteAddr().String())
 
 		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
-			conn.Close()
+			tcpConn.Close()
 			continue
 		}
+		var conn net.Conn = tcpConn
+		if tlsConfig != nil {
+			conn = tls.Server(tcpConn, tlsConfig)
+		}
 		n += 1
-		cs := &Session{conn: conn, ip: ip}
+		cs := &Session{conn: conn, ip: ip, timeout: timeout, solo: cfg.Solo}
+		s.initVarDiff(cs)
 
 		accept <- n
 		go func(cs *Session) {
-			err = s.handleTCPClient(cs)
+			err := s.handleTCPClient(cs)
 			if err != nil {
 				s.removeSession(cs)
-				conn.Close()
+				cs.conn.Close()
 			}
 			<-accept
 		}(cs)
@@ -65,7 +86,7 @@ func (s *ProxyServer) ListenTCP() {
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
-	s.setDeadline(cs.conn)
+	cs.setDeadline()
 
 	for {
 		data, isPrefix, err := connbuff.ReadLine()
@@ -90,8 +111,16 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 				log.Printf("Malformed stratum request from %s: %v", cs.ip, err)
 				return err
 			}
-			s.setDeadline(cs.conn)
-			err = cs.handleTCPMessage(s, &req)
+			cs.setDeadline()
+			// NiceHash miners start with mining.subscribe
+			if len(cs.login) == 0 && req.Method == "mining.subscribe" {
+				cs.es = true
+			}
+			if cs.es {
+				err = cs.handleESMessage(s, &req)
+			} else {
+				err = cs.handleTCPMessage(s, &req)
+			}
 			if err != nil {
 				return err
 			}
@@ -114,7 +143,11 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
-		return cs.sendTCPResult(req.Id, reply)
+		err = cs.sendTCPResult(req.Id, reply)
+		if err != nil {
+			return err
+		}
+		return s.pushLoginJob(cs)
 	case "eth_getWork":
 		reply, errReply := s.handleGetWorkRPC(cs)
 		if errReply != nil {
@@ -132,9 +165,19 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
-		return cs.sendTCPResult(req.Id, &reply)
+		err = cs.sendTCPResult(req.Id, &reply)
+		if err != nil {
+			return err
+		}
+		// Send job with a new target right away
+		if reply && s.retarget(cs) {
+			return s.pushJob(cs)
+		}
+		return nil
 	case "eth_submitHashrate":
-		return cs.sendTCPResult(req.Id, true)
+		var params []string
+		json.Unmarshal(req.Params, &params)
+		return cs.sendTCPResult(req.Id, s.handleSubmitHashrateRPC(cs, cs.ip, cs.login, req.Worker, params))
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		return cs.sendTCPError(req.Id, errReply)
@@ -157,6 +200,35 @@ func (cs *Session) pushNewJob(result interface{}) error {
 	return cs.enc.Encode(&message)
 }
 
+func (s *ProxyServer) pushJob(cs *Session) error {
+	block := cs.currentTemplate()
+	if block == nil || len(block.Header) == 0 || s.isSick() {
+		return nil
+	}
+	return s.sendJob(cs, block)
+}
+
+// Work depends on coinbase, so job of a logged in miner is fetched right away as HTTP getwork does.
+// New job is sent by template update, the current one is pushed if work hasn't changed.
+func (s *ProxyServer) pushLoginJob(cs *Session) error {
+	t := cs.currentTemplate()
+	s.fetchSessionTemplate(s.rpc(), cs)
+	if cs.currentTemplate() != t {
+		return nil
+	}
+	return s.pushJob(cs)
+}
+
+// Sends job in a format of session protocol
+func (s *ProxyServer) sendJob(cs *Session, block *BlockTemplate) error {
+	diff, target := cs.difficulty(s)
+	if cs.es {
+		return cs.pushESJob(block, diff)
+	}
+	replyBlock := []string{block.Header, block.Seed, target, util.ToHex(int64(block.Height))}
+	return cs.pushNewJob(&replyBlock)
+}
+
 func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
 	cs.Lock()
 	defer cs.Unlock()
@@ -169,8 +241,8 @@ func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
 	return errors.New(reply.Message)
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(self.timeout))
+func (cs *Session) setDeadline() {
+	cs.conn.SetDeadline(time.Now().Add(cs.timeout))
 }
 
 func (s *ProxyServer) registerSession(cs *Session) {
@@ -185,41 +257,33 @@ func (s *ProxyServer) removeSession(cs *Session) {
 	delete(s.sessions, cs)
 }
 
-func (s *ProxyServer) broadcastNewJobs() {
+func (s *ProxyServer) activeSessions() []*Session {
 	s.sessionsMu.RLock()
 	defer s.sessionsMu.RUnlock()
 
-	count := 0
-	start := time.Now()
-	bcast := make(chan int, 1024)
-	n := 0
+	sessions := make([]*Session, 0, len(s.sessions))
+	for cs := range s.sessions {
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
 
-	for m, _ := range s.sessions {
-		n++
-		bcast <- n
-		go func(cs *Session) {
-			s.sessionsMu.Lock()
-			defer s.sessionsMu.Unlock()
-			log.Printf("check status: %v, %v, %v", cs.login, s.updateMap[cs.login], n)
-			if s.updateMap[cs.login] == false {
-				return
-			}
-			count++
-			block := s.currentBlockTemplateWithId(cs.login)
-			if block == nil || len(block.Header) == 0 || s.isSick() {
-				return
-			}
-			replyBlock := []string{block.Header, block.Seed, s.diff, util.ToHex(int64(block.Height))}
-			err := cs.pushNewJob(&replyBlock)
-			<-bcast
-			if err != nil {
-				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
-				s.removeSession(cs)
-			} else {
-				s.setDeadline(cs.conn)
-			}
-			log.Printf("Broadcasting new job to %s stratum miners, %v, %s, height:, %s", cs.login, n, time.Since(start), int64(block.Height))
-		}(m)
+// Stratum sessions need a new job pushed, HTTP miners poll for it
+func (cs *Session) isStratum() bool {
+	return cs.conn != nil
+}
+
+// Sends freshly fetched job to the session
+func (s *ProxyServer) notifySession(cs *Session, block *BlockTemplate) {
+	if len(block.Header) == 0 || s.isSick() || s.isStopping() {
+		return
+	}
+	s.retarget(cs)
+	err := s.sendJob(cs, block)
+	if err != nil {
+		log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+		s.removeSession(cs)
+	} else {
+		cs.setDeadline()
 	}
-	//log.Printf("Jobs broadcast finished %s", time.Since(start))
 }
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keeps stratum TLS certificate and reloads it once files are changed on disk.
+// Only new handshakes get the new certificate, established sessions are kept.
+type certLoader struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	modTime, err := l.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	return l, l.load(modTime)
+}
+
+func (l *certLoader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, f := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (l *certLoader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
+
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	modTime, err := l.lastModified()
+	if err == nil && !modTime.Equal(l.modTime) {
+		// Keep serving old certificate if new one is broken or half written
+		if err := l.load(modTime); err != nil {
+			log.Printf("Failed to reload stratum TLS certificate: %v", err)
+		} else {
+			log.Printf("Reloaded stratum TLS certificate %s", l.certFile)
+		}
+	}
+	return l.cert, nil
+}
+
+func (s *ProxyServer) ListenTLS(cfg *Stratum) {
+	loader, err := newCertLoader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load stratum TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{GetCertificate: loader.GetCertificate, MinVersion: tls.VersionTLS12}
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.TLS.Listen)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	server, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer server.Close()
+
+	log.Printf("Stratum TLS listening on %s", cfg.TLS.Listen)
+	s.serveTCP(server, cfg, tlsConfig)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Shares of jobs sent before retarget are checked against previous difficulty for this long
+const prevDiffGrace = 30 * time.Second
+
+type VarDiff struct {
+	Enabled bool  `json:"enabled"`
+	MinDiff int64 `json:"minDiff"`
+	MaxDiff int64 `json:"maxDiff"`
+	// Desired number of shares per minute from a single session
+	SharesPerMinute  float64 `json:"sharesPerMinute"`
+	RetargetInterval string  `json:"retargetInterval"`
+	// Don't bother miner with a new target if difficulty changes less than this percent
+	Variance float64 `json:"variance"`
+}
+
+// Difficulty of a session, HTTP miners and stratum without vardiff get static one
+func (cs *Session) difficulty(s *ProxyServer) (int64, string) {
+	cs.diffMu.Lock()
+	defer cs.diffMu.Unlock()
+	if cs.diff == 0 {
+		return s.config.Proxy.Difficulty, s.diff
+	}
+	return cs.diff, cs.target
+}
+
+// Previous difficulty is still accepted for shares of jobs sent before retarget, for a short grace period
+func (cs *Session) previousDifficulty(jobSeq uint64) int64 {
+	cs.diffMu.Lock()
+	defer cs.diffMu.Unlock()
+	if jobSeq > cs.prevDiffSeq || time.Now().After(cs.prevDiffUntil) {
+		return 0
+	}
+	return cs.prevDiff
+}
+
+func (s *ProxyServer) initVarDiff(cs *Session) {
+	cfg := &s.config.Proxy.VarDiff
+	if !cfg.Enabled {
+		return
+	}
+	cs.diffMu.Lock()
+	defer cs.diffMu.Unlock()
+	cs.diff = clampDiff(s.config.Proxy.Difficulty, cfg)
+	cs.target = util.GetTargetHex(cs.diff)
+	cs.lastRetarget = time.Now()
+}
+
+func (cs *Session) countShare() {
+	cs.diffMu.Lock()
+	cs.shares++
+	cs.diffMu.Unlock()
+}
+
+// Adjusts session difficulty to the configured share rate, returns true if miner must get a new target
+func (s *ProxyServer) retarget(cs *Session) bool {
+	cfg := &s.config.Proxy.VarDiff
+	if !cfg.Enabled {
+		return false
+	}
+	cs.diffMu.Lock()
+	defer cs.diffMu.Unlock()
+	if cs.diff == 0 {
+		return false
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(cs.lastRetarget)
+	if elapsed < s.retargetIntv {
+		return false
+	}
+
+	var newDiff int64
+	if cs.shares == 0 {
+		// Nothing submitted for a whole interval, step down quickly
+		newDiff = cs.diff / 2
+	} else {
+		rate := float64(cs.shares) / elapsed.Minutes()
+		newDiff = int64(float64(cs.diff) * rate / cfg.SharesPerMinute)
+	}
+	newDiff = clampDiff(newDiff, cfg)
+	cs.shares = 0
+	cs.lastRetarget = now
+
+	change := math.Abs(float64(newDiff-cs.diff)) / float64(cs.diff) * 100
+	if newDiff == cs.diff || change < cfg.Variance {
+		return false
+	}
+	log.Printf("Retarget %v@%v from %v to %v", cs.login, cs.ip, cs.diff, newDiff)
+	cs.prevDiff = cs.diff
+	cs.prevDiffUntil = now.Add(prevDiffGrace)
+	if t := cs.currentTemplate(); t != nil {
+		cs.prevDiffSeq = t.headers[t.Header].seq
+	}
+	cs.diff = newDiff
+	cs.target = util.GetTargetHex(newDiff)
+	return true
+}
+
+// Zero difficulty has no target, it never goes below 1 even if minDiff is unset
+func clampDiff(diff int64, cfg *VarDiff) int64 {
+	if diff < 1 {
+		diff = 1
+	}
+	if diff < cfg.MinDiff {
+		return cfg.MinDiff
+	}
+	if cfg.MaxDiff > 0 && diff > cfg.MaxDiff {
+		return cfg.MaxDiff
+	}
+	return diff
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClampDiff(t *testing.T) {
+	if diff := clampDiff(0, &VarDiff{}); diff != 1 {
+		t.Errorf("Difficulty must never drop to zero, got %v", diff)
+	}
+	cfg := &VarDiff{MinDiff: 100, MaxDiff: 1000}
+	if diff := clampDiff(50, cfg); diff != 100 {
+		t.Errorf("Difficulty must be raised to minimum, got %v", diff)
+	}
+	if diff := clampDiff(5000, cfg); diff != 1000 {
+		t.Errorf("Difficulty must be lowered to maximum, got %v", diff)
+	}
+}
+
+func TestPreviousDifficulty(t *testing.T) {
+	cs := &Session{diff: 200, prevDiff: 100, prevDiffSeq: 5, prevDiffUntil: time.Now().Add(prevDiffGrace)}
+
+	if diff := cs.previousDifficulty(5); diff != 100 {
+		t.Errorf("Job sent before retarget must accept previous difficulty, got %v", diff)
+	}
+	if diff := cs.previousDifficulty(6); diff != 0 {
+		t.Errorf("Job sent after retarget must not accept previous difficulty, got %v", diff)
+	}
+	cs.prevDiffUntil = time.Now().Add(-time.Second)
+	if diff := cs.previousDifficulty(5); diff != 0 {
+		t.Errorf("Previous difficulty must expire, got %v", diff)
+	}
+}
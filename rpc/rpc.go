@@ -18,10 +18,6 @@ import (
 	"github.com/sammy007/open-ethereum-pool/util"
 )
 
-var (
-	currentShardId string
-)
-
 type RPCClient struct {
 	sync.RWMutex
 	Url         string
@@ -93,6 +89,7 @@ type AccountBalance struct {
 type GetRootBlockReply struct {
 	Number            string             `json:"height"`
 	Hash              string             `json:"hash"`
+	ParentHash        string             `json:"hashPrevBlock"`
 	Nonce             string             `json:"nonce"`
 	Miner             string             `json:"miner"`
 	Difficulty        string             `json:"difficulty"`
@@ -132,7 +129,6 @@ func (r *RPCClient) GetWork(shardId string) ([]string, error) {
 }
 
 func (r *RPCClient) GetWorkWithID(shardId string, login string) ([]string, error) {
-	currentShardId = shardId
 	rpcResp, err := r.doPost(r.Url, "getWork", []string{shardId, login})
 	if err != nil {
 		return nil, err
@@ -191,7 +187,20 @@ func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
 	if rpcResp.Result != nil {
 		var reply *TxReceipt
 		err = json.Unmarshal(*rpcResp.Result, &reply)
-		fmt.Println(reply.BlockHash)
+		return reply, err
+	}
+	return nil, nil
+}
+
+// Nil if node doesn't know such tx
+func (r *RPCClient) GetTransaction(hash string) (*Tx, error) {
+	rpcResp, err := r.doPost(r.Url, "getTransactionById", []string{hash})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *Tx
+		err = json.Unmarshal(*rpcResp.Result, &reply)
 		return reply, err
 	}
 	return nil, nil
@@ -223,82 +232,58 @@ func (r *RPCClient) GetLastestRootBlock() (string, error) {
 	return "", nil
 }
 
-// Get the lastest root block information
-func (r *RPCClient) GetRootBlockByHeight(shardId string, height int64) (string, error) {
-	var correct_height string
+// Root block at given height with headers of all minor blocks it confirms, nil if there is no such block yet
+func (r *RPCClient) GetRootBlock(height int64) (*GetRootBlockReply, error) {
 	params := []interface{}{fmt.Sprintf("0x%x", height)}
-	rpcResp, err_root := r.doPost(r.Url, "getRootBlockByHeight", params)
-	if err_root != nil {
-		return correct_height, err_root
+	rpcResp, err := r.doPost(r.Url, "getRootBlockByHeight", params)
+	if err != nil {
+		return nil, err
 	}
 	if rpcResp.Result != nil {
 		var reply *GetRootBlockReply
-		err := json.Unmarshal(*rpcResp.Result, &reply)
-		if err != nil {
-			return correct_height, err
-		}
-		for _, minorBlock := range reply.MinorBlockHeaders {
-			//var minor_reply *MinorBlockHeader
-			//err_minor := json.Unmarshal(*minorBlocks, &minor_reply)
-			//if err_minor != nil {
-			//	return correct_height, err_minor
-			//}
-			if minorBlock.FullShardId != shardId {
-				continue
-			}
-			if CompareHeight(minorBlock.Height, correct_height) {
-				correct_height = minorBlock.Height
-			}
-		}
-		return correct_height, err
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
 	}
-	return correct_height, nil
+	return nil, nil
 }
 
-func CompareHeight(reply_height string, correct_height string) bool {
-	if correct_height == "" {
-		return true
-	}
-	correctHeight, err := strconv.ParseInt(strings.Replace(correct_height, "0x", "", -1), 16, 64)
+// Balance of a native token in Wei
+func (r *RPCClient) GetBalance(address, shardId, token string) (*big.Int, error) {
+	balances, err := r.GetBalances(address, shardId)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	replyHeight, err_reply := strconv.ParseInt(strings.Replace(reply_height, "0x", "", -1), 16, 64)
-	if err_reply != nil {
-		return false
+	if balance, ok := balances[token]; ok {
+		return balance, nil
 	}
-	return replyHeight > correctHeight
+	return new(big.Int), nil
 }
 
-func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
-	qkcAddress := address + "000" + currentShardId[2:len(currentShardId)]
-	log.Printf("get balance  qkcAddress:,%v", qkcAddress)
+// Balances of all native tokens in Wei by token name.
+// Full shard key of shard is appended to 20 bytes account, address carrying its own key is queried as is.
+func (r *RPCClient) GetBalances(address string, shardId string) (map[string]*big.Int, error) {
+	qkcAddress := address
+	if len(address) == 42 {
+		key, err := util.FullShardKey(shardId)
+		if err != nil {
+			return nil, err
+		}
+		qkcAddress += key[2:]
+	}
 	rpcResp, err := r.doPost(r.Url, "getBalances", []string{qkcAddress})
 	if err != nil {
-		log.Printf("get balance  err:,%v", err)
 		return nil, err
 	}
-	//var reply []string
 	var reply *AccountBalance
 	err = json.Unmarshal(*rpcResp.Result, &reply)
 	if err != nil {
-		log.Printf("get balance  err1:,%v", err)
 		return nil, err
 	}
-	var balanceInt64 int64
+	balances := make(map[string]*big.Int)
 	for _, balanceMap := range reply.Balance {
-		if balanceMap.TokenStr != "QKC" {
-			continue
-		}
-		balance, _ := new(big.Float).SetString(balanceMap.Balance)
-		log.Printf("get balancemap balance  :%v ", balanceMap.Balance)
-		ten9 := new(big.Int).Exp(big.NewInt(10), big.NewInt(9), big.NewInt(0))
-		log.Printf("get balance  :%v  and  two18:%v", balance, ten9)
-		balanceInt64, _ = new(big.Float).Quo(balance, big.NewFloat(float64(ten9.Int64()))).Int64()
+		balances[strings.ToUpper(balanceMap.TokenStr)] = util.String2Big(balanceMap.Balance)
 	}
-	fmt.Println("balacneMap.Balance is:", balanceInt64)
-	//fmt.Println("balacneMap.Balance value is : ", util.String2Big(balanceString))
-	return big.NewInt(balanceInt64), err
+	return balances, nil
 }
 
 func (r *RPCClient) Sign(from string, s string) (string, error) {
@@ -360,6 +345,38 @@ func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoG
 	return reply, err
 }
 
+// Returns the nonce of a QuarkChain account, address must include the full shard key
+func (r *RPCClient) GetTransactionCount(address string) (uint64, error) {
+	rpcResp, err := r.doPost(r.Url, "getTransactionCount", []string{address})
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+// Submits RLP encoded and signed transaction, returns QuarkChain tx id (hash + full shard key)
+func (r *RPCClient) SendRawTransaction(rawTx string) (string, error) {
+	rpcResp, err := r.doPost(r.Url, "sendRawTransaction", []string{rawTx})
+	var reply string
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return reply, err
+	}
+	// Node replies with zero tx id if it refused to add transaction to the pool
+	if util.IsZeroHash(reply) {
+		err = errors.New("transaction was rejected by node")
+	}
+	return reply, err
+}
+
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, _ := json.Marshal(jsonReq)
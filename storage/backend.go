@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"math/big"
+	"time"
+)
+
+// Share accounting done by proxy for every valid submit
+type ShareStorage interface {
+	WriteShare(login, id string, balance, credit *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error)
+	WriteBlock(login, id string, balance, credit *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error)
+	WriteSoloShare(login, id string, balance *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error)
+	WriteSoloBlock(login, id string, balance *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error)
+	WriteShareStat(login, id, status string) error
+	WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error
+	WriteNodeState(id string, height uint64, diff *big.Int) error
+}
+
+// Block candidates and their lifecycle until maturity, driven by unlocker
+type BlockStorage interface {
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+	GetShareWindow(seq, maxShares, maxDiff int64) (map[string]int64, error)
+	ReplaceRoundShares(height int64, nonce string, shares map[string]int64) error
+	WriteImmatureBlock(block *BlockData, roundRewards TokenRewards) error
+	WriteMaturedBlock(block *BlockData, roundRewards TokenRewards) error
+	WritePPSMaturedBlock(block *BlockData, roundRewards TokenRewards) error
+	WriteOrphan(block *BlockData) error
+	WritePendingOrphans(blocks []*BlockData) error
+	GetAverageReward(n int64) (*big.Int, error)
+}
+
+// Minor blocks of pool shard indexed by root blocks which confirmed them, walked by unlocker
+type RootIndexStorage interface {
+	GetRootIndex() (*RootIndex, error)
+	// Index as of indexed root block at given height, nil if it's out of window
+	GetIndexedRoot(height int64) (*RootIndex, error)
+	WriteRootBlock(index *RootIndex, minorHashes []string, window int64) error
+	RewindRootIndex(index *RootIndex) error
+	GetRootConfirmations(hashes []string) (map[string]int64, error)
+}
+
+// Miner balances in Wei, kept per native token
+type BalanceStorage interface {
+	GetPayees() ([]string, error)
+	GetBalance(login, token string) (*big.Int, error)
+	UpdateBalance(login, token string, amount *big.Int) error
+	RollbackBalance(login, token string, amount *big.Int) error
+}
+
+// Payouts lock, payout plans and payments log
+type PaymentStorage interface {
+	LockPayouts(login string, amount *big.Int) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	WritePayment(login, token, txHash string, amount *big.Int) error
+	CreatePayoutPlan(plan *PayoutPlan) error
+	GetPayoutPlan() (*PayoutPlan, error)
+	UpdatePlannedPayment(planId string, p *PlannedPayment) error
+	WritePlannedPayment(planId string, p *PlannedPayment) error
+	FailPlannedPayment(planId string, p *PlannedPayment) error
+	FinishPayoutPlan(planId string) error
+}
+
+// Addresses and IPs managed by operator
+type PolicyStorage interface {
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+}
+
+// Read side used by API
+type StatsStorage interface {
+	GetNodeStates() (map[string]interface{}, error)
+	IsMinerExists(login string) (bool, error)
+	GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error)
+	FlushStaleStats(window, largeWindow time.Duration) (int64, error)
+	CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	CollectProfits(login string) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	CollectMinerBlockStats(login string, maxBlocks int64) (map[string]interface{}, error)
+	CollectLuckStats(windows []int) (map[string]interface{}, error)
+	CollectPPSStats() (map[string]interface{}, error)
+	GetMills(smallWindow time.Duration) (map[string]Miner, error)
+}
+
+// Everything pool keeps in storage, implemented by RedisClient and MemoryClient
+type Backend interface {
+	ShareStorage
+	BlockStorage
+	RootIndexStorage
+	BalanceStorage
+	PaymentStorage
+	PolicyStorage
+	StatsStorage
+
+	Check() (string, error)
+	BgSave() (string, error)
+	Close() error
+	SetShareLogSize(size int64)
+	Namespace(ns string) Backend
+	Migrate() error
+	// Whether money is kept in Wei already, read only
+	Migrated() (bool, error)
+}
+
+var _ Backend = (*RedisClient)(nil)
+var _ Backend = (*MemoryClient)(nil)
@@ -0,0 +1,1180 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// In-process storage with the same keys and semantics as RedisClient.
+// Nothing is persisted, meant for development and unit tests.
+type MemoryClient struct {
+	db     *memoryDB
+	prefix string
+	// Number of last shares kept in a share log for PPLNS, 0 disables logging
+	shareLogSize int64
+}
+
+// Minimal keyspace of Redis types used by pool, every client method holds the lock
+// for its whole duration which makes it as atomic as MULTI on Redis
+type memoryDB struct {
+	sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	lists   map[string][]string
+	sets    map[string]map[string]struct{}
+	expires map[string]int64
+}
+
+func NewMemoryClient(prefix string) *MemoryClient {
+	db := &memoryDB{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]struct{}),
+		expires: make(map[string]int64),
+	}
+	return &MemoryClient{db: db, prefix: prefix}
+}
+
+func (m *MemoryClient) Close() error {
+	return nil
+}
+
+// Returns client sharing the same data with keys prefixed by namespace
+func (m *MemoryClient) Namespace(ns string) Backend {
+	n := *m
+	n.prefix = join(m.prefix, ns)
+	return &n
+}
+
+// Nothing to convert, memory storage never outlives the process
+func (m *MemoryClient) Migrate() error {
+	return nil
+}
+
+func (m *MemoryClient) Migrated() (bool, error) {
+	return true, nil
+}
+
+func (m *MemoryClient) SetShareLogSize(size int64) {
+	m.shareLogSize = size
+}
+
+func (m *MemoryClient) Check() (string, error) {
+	return "PONG", nil
+}
+
+func (m *MemoryClient) BgSave() (string, error) {
+	return "Nothing to save, in-memory storage", nil
+}
+
+// Adds address to blacklist, there is no redis-cli to do it
+func (m *MemoryClient) AddToBlacklist(login string) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	m.db.sadd(m.formatKey("blacklist"), login)
+}
+
+// Adds IP to whitelist, there is no redis-cli to do it
+func (m *MemoryClient) AddToWhitelist(ip string) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	m.db.sadd(m.formatKey("whitelist"), ip)
+}
+
+func (m *MemoryClient) GetBlacklist() ([]string, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return m.db.smembers(m.formatKey("blacklist")), nil
+}
+
+func (m *MemoryClient) GetWhitelist() ([]string, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return m.db.smembers(m.formatKey("whitelist")), nil
+}
+
+func (m *MemoryClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+
+	m.db.hset(m.formatKey("nodes"), join(id, "name"), id)
+	m.db.hset(m.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
+	m.db.hset(m.formatKey("nodes"), join(id, "difficulty"), diff.String())
+	m.db.hset(m.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	return nil
+}
+
+func (m *MemoryClient) WriteShareStat(login, id, status string) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+	key := m.formatKey("sharestats", login, now-now%shareStatsBucket)
+
+	m.db.hincrby(key, join(id, status), 1)
+	m.db.expire(key, time.Duration(shareStatsBucket*(shareStatsBuckets+1))*time.Second)
+	return nil
+}
+
+func (m *MemoryClient) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+
+	m.db.hset(m.formatKey("reported", login), id, join(hashrate, clientId, now))
+	m.db.expire(m.formatKey("reported", login), expire)
+	return nil
+}
+
+func (m *MemoryClient) GetNodeStates() (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return convertNodeStates(m.db.hgetall(m.formatKey("nodes"))), nil
+}
+
+func (m *MemoryClient) checkPoWExist(height uint64, params []string) bool {
+	m.db.zremBelow(m.formatKey("pow"), float64(height-8))
+	return !m.db.zadd(m.formatKey("pow"), float64(height), strings.Join(params, ":"))
+}
+
+func (m *MemoryClient) WriteShare(login, id string, balance, credit *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	seq := m.nextShareSeq()
+
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, balance, credit, diff, seq, window)
+	m.db.hincrby(m.formatKey("stats"), "roundShares", diff)
+	return false, nil
+}
+
+func (m *MemoryClient) WriteBlock(login, id string, balance, credit *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	seq := m.nextShareSeq()
+
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, balance, credit, diff, seq, window)
+	m.db.hset(m.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+	m.db.hdel(m.formatKey("stats"), "roundShares")
+	m.db.zincrby(m.formatKey("finders"), 1, login)
+	m.db.hincrby(m.formatKey("miners", login), "blocksFound", 1)
+	err := m.db.rename(m.formatKey("shares", "roundCurrent"), m.formatRound(int64(height), params[0]))
+	if err != nil {
+		return false, err
+	}
+	totalShares := int64(0)
+	for _, v := range m.db.hgetall(m.formatRound(int64(height), params[0])) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		totalShares += n
+	}
+	hashHex := strings.Join(params, ":")
+	s := join(hashHex, ts, roundDiff, totalShares, login, seq)
+	m.db.zadd(m.formatKey("blocks", "candidates"), float64(height), s)
+	return false, nil
+}
+
+func (m *MemoryClient) WriteSoloShare(login, id string, balance *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeHashrate(ms, ts, login, id, balance, diff, window)
+	return false, nil
+}
+
+func (m *MemoryClient) WriteSoloBlock(login, id string, balance *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeHashrate(ms, ts, login, id, balance, diff, window)
+	m.db.zincrby(m.formatKey("finders"), 1, login)
+	m.db.hincrby(m.formatKey("miners", login), "blocksFound", 1)
+	hashHex := strings.Join(params, ":")
+	s := join(hashHex, ts, roundDiff, int64(0), login, int64(0), true)
+	m.db.zadd(m.formatKey("blocks", "candidates"), float64(height), s)
+	return false, nil
+}
+
+func (m *MemoryClient) writeShare(ms, ts int64, login, id string, balance, credit *big.Int, diff, seq int64, expire time.Duration) {
+	m.db.hincrby(m.formatKey("shares", "roundCurrent"), login, diff)
+	if seq > 0 {
+		m.db.zadd(m.formatKey("shares", "log"), float64(seq), join(diff, login, seq))
+		m.db.zkeepLast(m.formatKey("shares", "log"), m.shareLogSize)
+	}
+	m.writeHashrate(ms, ts, login, id, balance, diff, expire)
+	if credit != nil && credit.Sign() != 0 {
+		m.db.hincrbig(m.formatKey("miners", login), "balance", credit)
+		m.db.hincrbig(m.formatKey("finances"), "balance", credit)
+		m.db.hincrbig(m.formatKey("finances"), "ppsLiability", credit)
+	}
+}
+
+func (m *MemoryClient) writeHashrate(ms, ts int64, login, id string, balance *big.Int, diff int64, expire time.Duration) {
+	m.db.zadd(m.formatKey("hashrate"), float64(ts), join(diff, login, id, ms))
+	m.db.zadd(m.formatKey("hashrate", login), float64(ts), join(diff, id, ms))
+	m.db.expire(m.formatKey("hashrate", login), expire)
+	m.db.hset(m.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	if balance != nil {
+		m.db.hset(m.formatKey("miners", login), "balance", balance.String())
+	}
+}
+
+func (m *MemoryClient) nextShareSeq() int64 {
+	if m.shareLogSize <= 0 {
+		return 0
+	}
+	key := m.formatKey("shares", "seq")
+	seq, _ := strconv.ParseInt(m.db.get(key), 10, 64)
+	seq++
+	m.db.set(key, strconv.FormatInt(seq, 10))
+	return seq
+}
+
+func (m *MemoryClient) formatKey(args ...interface{}) string {
+	return join(m.prefix, join(args...))
+}
+
+func (m *MemoryClient) formatRound(height int64, nonce string) string {
+	return m.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (m *MemoryClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	rows := m.db.zrangeByScore(m.formatKey("blocks", "candidates"), 0, float64(maxHeight))
+	return convertCandidateResults(rows), nil
+}
+
+func (m *MemoryClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	rows := m.db.zrangeByScore(m.formatKey("blocks", "immature"), 0, float64(maxHeight))
+	return convertBlockResults(rows), nil
+}
+
+func (m *MemoryClient) GetRootIndex() (*RootIndex, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return convertRootIndex(m.db.hgetall(m.formatKey("roots"))), nil
+}
+
+func (m *MemoryClient) WriteRootBlock(index *RootIndex, minorHashes []string, window int64) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	key := m.formatKey("roots", "confirmations")
+	chainKey := m.formatKey("roots", "chain")
+	for _, hash := range minorHashes {
+		m.db.zadd(key, float64(index.Height), strings.ToLower(hash))
+	}
+	for _, row := range m.db.zrangeByScore(chainKey, float64(index.Height), float64(index.Height)) {
+		m.db.zrem(chainKey, row.Member.(string))
+	}
+	m.db.zadd(chainKey, float64(index.Height), index.chainMember())
+	m.writeRootIndex(index)
+	m.db.zremBelow(key, float64(index.Height-window))
+	m.db.zremBelow(chainKey, float64(index.Height-window))
+	return nil
+}
+
+func (m *MemoryClient) RewindRootIndex(index *RootIndex) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	m.db.zremAbove(m.formatKey("roots", "confirmations"), float64(index.Height))
+	m.db.zremAbove(m.formatKey("roots", "chain"), float64(index.Height))
+	m.writeRootIndex(index)
+	return nil
+}
+
+func (m *MemoryClient) GetIndexedRoot(height int64) (*RootIndex, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	rows := m.db.zrangeByScore(m.formatKey("roots", "chain"), float64(height), float64(height))
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return convertRootChain(rows[0].Member.(string)), nil
+}
+
+func (m *MemoryClient) writeRootIndex(index *RootIndex) {
+	key := m.formatKey("roots")
+	m.db.hset(key, "height", strconv.FormatInt(index.Height, 10))
+	m.db.hset(key, "hash", index.Hash)
+	m.db.hset(key, "minorHeight", strconv.FormatInt(index.MinorHeight, 10))
+}
+
+func (m *MemoryClient) GetRootConfirmations(hashes []string) (map[string]int64, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return m.getRootConfirmations(hashes), nil
+}
+
+func (m *MemoryClient) getRootConfirmations(hashes []string) map[string]int64 {
+	result := make(map[string]int64)
+	confirmations := m.db.zset(m.formatKey("roots", "confirmations"), false)
+	for _, hash := range hashes {
+		if height, ok := confirmations[strings.ToLower(hash)]; ok {
+			result[strings.ToLower(hash)] = int64(height)
+		}
+	}
+	return result
+}
+
+func (m *MemoryClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	result := make(map[string]int64)
+	for login, v := range m.db.hgetall(m.formatRound(height, nonce)) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result, nil
+}
+
+func (m *MemoryClient) GetShareWindow(seq, maxShares, maxDiff int64) (map[string]int64, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	result := make(map[string]int64)
+	var count, total int64
+	rows := m.db.zrangeByScore(m.formatKey("shares", "log"), math.Inf(-1), float64(seq))
+	for i := len(rows) - 1; i >= 0; i-- {
+		// "diff:login:seq"
+		fields := strings.Split(rows[i].Member.(string), ":")
+		diff, _ := strconv.ParseInt(fields[0], 10, 64)
+		if maxDiff > 0 && total+diff > maxDiff {
+			diff = maxDiff - total
+		}
+		result[fields[1]] += diff
+		total += diff
+		count++
+		if (maxShares > 0 && count >= maxShares) || (maxDiff > 0 && total >= maxDiff) {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryClient) ReplaceRoundShares(height int64, nonce string, shares map[string]int64) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	m.db.del(m.formatRound(height, nonce))
+	for login, n := range shares {
+		m.db.hincrby(m.formatRound(height, nonce), login, n)
+	}
+	return nil
+}
+
+func (m *MemoryClient) GetPayees() ([]string, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	var result []string
+	prefix := m.formatKey("miners") + ":"
+	for key := range m.db.hashes {
+		if strings.HasPrefix(key, prefix) && m.db.hash(key, false) != nil {
+			result = append(result, strings.TrimPrefix(key, prefix))
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryClient) GetBalance(login, token string) (*big.Int, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	v, ok := m.db.hash(m.formatKey("miners", login), false)[withToken("balance", token)]
+	if !ok {
+		return new(big.Int), nil
+	}
+	return parseWei(v)
+}
+
+func (m *MemoryClient) LockPayouts(login string, amount *big.Int) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	key := m.formatKey("payments", "lock")
+	if !m.db.setnx(key, join(login, amount)) {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+	return nil
+}
+
+func (m *MemoryClient) UnlockPayouts() error {
+	m.db.Lock()
+	defer m.db.Unlock()
+	m.db.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryClient) IsPayoutsLocked() (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return m.db.exists(m.formatKey("payments", "lock")), nil
+}
+
+func (m *MemoryClient) GetPendingPayments() []*PendingPayment {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	return convertPendingPayments(m.db.zrevrange(m.formatKey("payments", "pending"), 0, -1))
+}
+
+func (m *MemoryClient) UpdateBalance(login, token string, amount *big.Int) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+
+	m.debitBalance(ts, login, token, amount)
+	return nil
+}
+
+func (m *MemoryClient) debitBalance(ts int64, login, token string, amount *big.Int) {
+	m.db.hincrbig(m.formatKey("miners", login), withToken("balance", token), neg(amount))
+	m.db.hincrbig(m.formatKey("miners", login), withToken("pending", token), amount)
+	m.db.hincrbig(m.formatKey("finances"), withToken("balance", token), neg(amount))
+	m.db.hincrbig(m.formatKey("finances"), withToken("pending", token), amount)
+	m.db.zadd(m.formatKey("payments", "pending"), float64(ts), withToken(join(login, amount), token))
+}
+
+func (m *MemoryClient) RollbackBalance(login, token string, amount *big.Int) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+	m.rollbackBalance(login, token, amount)
+	return nil
+}
+
+func (m *MemoryClient) rollbackBalance(login, token string, amount *big.Int) {
+	m.db.hincrbig(m.formatKey("miners", login), withToken("balance", token), amount)
+	m.db.hincrbig(m.formatKey("miners", login), withToken("pending", token), neg(amount))
+	m.db.hincrbig(m.formatKey("finances"), withToken("balance", token), amount)
+	m.db.hincrbig(m.formatKey("finances"), withToken("pending", token), neg(amount))
+	m.db.zrem(m.formatKey("payments", "pending"), withToken(join(login, amount), token))
+}
+
+func (m *MemoryClient) WritePayment(login, token, txHash string, amount *big.Int) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+
+	m.writePayment(ts, login, token, txHash, amount)
+	m.db.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryClient) writePayment(ts int64, login, token, txHash string, amount *big.Int) {
+	m.db.hincrbig(m.formatKey("miners", login), withToken("pending", token), neg(amount))
+	m.db.hincrbig(m.formatKey("miners", login), withToken("paid", token), amount)
+	m.db.hincrbig(m.formatKey("finances"), withToken("pending", token), neg(amount))
+	m.db.hincrbig(m.formatKey("finances"), withToken("paid", token), amount)
+	m.db.zadd(m.formatKey("payments", "all"), float64(ts), withToken(join(txHash, login, amount), token))
+	m.db.zadd(m.formatKey("payments", login), float64(ts), withToken(join(txHash, amount), token))
+	m.db.zrem(m.formatKey("payments", "pending"), withToken(join(login, amount), token))
+}
+
+func (m *MemoryClient) CreatePayoutPlan(plan *PayoutPlan) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	key := m.formatKey("payments", "lock")
+	if !m.db.setnx(key, join("plan", plan.Id)) {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+
+	ts := util.MakeTimestamp() / 1000
+
+	for _, p := range plan.Payments {
+		m.debitBalance(ts, p.Address, p.Token, p.Amount)
+		m.db.hset(m.formatKey("payments", "plan", plan.Id), p.field(), p.key())
+	}
+	m.db.set(m.formatKey("payments", "plan"), plan.Id)
+	return nil
+}
+
+func (m *MemoryClient) GetPayoutPlan() (*PayoutPlan, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	key := m.formatKey("payments", "plan")
+	if !m.db.exists(key) {
+		return nil, nil
+	}
+	id := m.db.get(key)
+	return convertPayoutPlan(id, m.db.hgetall(m.formatKey("payments", "plan", id))), nil
+}
+
+func (m *MemoryClient) UpdatePlannedPayment(planId string, p *PlannedPayment) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+	m.db.hset(m.formatKey("payments", "plan", planId), p.field(), p.key())
+	return nil
+}
+
+func (m *MemoryClient) WritePlannedPayment(planId string, p *PlannedPayment) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+
+	m.writePayment(ts, p.Address, p.Token, p.TxHash, p.Amount)
+	m.db.hset(m.formatKey("payments", "plan", planId), p.field(), p.key())
+	return nil
+}
+
+func (m *MemoryClient) FailPlannedPayment(planId string, p *PlannedPayment) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	m.rollbackBalance(p.Address, p.Token, p.Amount)
+	m.db.hset(m.formatKey("payments", "plan", planId), p.field(), p.key())
+	return nil
+}
+
+func (m *MemoryClient) FinishPayoutPlan(planId string) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	m.db.expire(m.formatKey("payments", "plan", planId), finishedPlanTTL)
+	m.db.del(m.formatKey("payments", "plan"))
+	m.db.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryClient) WriteImmatureBlock(block *BlockData, roundRewards TokenRewards) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	err := m.writeImmatureBlock(block)
+	for token, rewards := range roundRewards {
+		total := new(big.Int)
+		for login, amount := range rewards {
+			total.Add(total, amount)
+			m.db.hincrbig(m.formatKey("miners", login), withToken("immature", token), amount)
+			m.db.hsetnx(m.formatKey("credits", "immature", block.Height, block.Hash), withToken(login, token), amount.String())
+		}
+		m.db.hincrbig(m.formatKey("finances"), withToken("immature", token), total)
+	}
+	return err
+}
+
+func (m *MemoryClient) WriteMaturedBlock(block *BlockData, roundRewards TokenRewards) error {
+	return m.writeMaturedCredits(block, roundRewards, false)
+}
+
+func (m *MemoryClient) WritePPSMaturedBlock(block *BlockData, roundRewards TokenRewards) error {
+	return m.writeMaturedCredits(block, roundRewards, true)
+}
+
+func (m *MemoryClient) writeMaturedCredits(block *BlockData, roundRewards TokenRewards, pps bool) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	ts := util.MakeTimestamp() / 1000
+	value := join(block.Hash, ts, block.Reward)
+
+	m.writeMaturedBlock(block)
+	m.db.zadd(m.formatKey("credits", "all"), float64(block.Height), value)
+	m.writeImmatureDebits(m.db.hgetall(creditKey))
+	// Increment balances
+	for token, rewards := range roundRewards {
+		total := new(big.Int)
+		for login, amount := range rewards {
+			total.Add(total, amount)
+			if token != util.DefaultToken {
+				m.db.hincrbig(m.formatKey("miners", login), withToken("balance", token), amount)
+			}
+			m.db.hsetnx(m.formatKey("credits", block.Height, block.Hash), withToken(login, token), amount.String())
+		}
+		m.db.hincrbig(m.formatKey("finances"), withToken("balance", token), total)
+	}
+	m.db.del(creditKey)
+	m.db.hset(m.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+	m.db.hset(m.formatKey("finances"), "lastCreditHash", block.Hash)
+	m.db.hincrbig(m.formatKey("finances"), "totalMined", block.Reward)
+	for token, reward := range block.TokenRewards {
+		m.db.hincrbig(m.formatKey("finances"), withToken("totalMined", token), reward)
+	}
+	if pps {
+		m.db.hincrbig(m.formatKey("finances"), "ppsRevenue", block.Reward)
+	}
+	m.db.lpush(m.formatKey("rewards"), block.Reward.String())
+	m.db.ltrim(m.formatKey("rewards"), maxRewardsLog)
+	return nil
+}
+
+func (m *MemoryClient) GetAverageReward(n int64) (*big.Int, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	rows := m.db.lrange(m.formatKey("rewards"), n)
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	total := new(big.Int)
+	for _, v := range rows {
+		reward, ok := new(big.Int).SetString(v, 10)
+		if !ok {
+			return nil, fmt.Errorf("Invalid reward %s in rewards log", v)
+		}
+		total.Add(total, reward)
+	}
+	return total.Div(total, big.NewInt(int64(len(rows)))), nil
+}
+
+func (m *MemoryClient) CollectPPSStats() (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	finances := m.db.hash(m.formatKey("finances"), false)
+	liability, _ := parseWei(orZero(finances["ppsLiability"]))
+	revenue, _ := parseWei(orZero(finances["ppsRevenue"]))
+	return convertPPSStats(liability, revenue), nil
+}
+
+func (m *MemoryClient) WriteOrphan(block *BlockData) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	m.writeMaturedBlock(block)
+	m.writeImmatureDebits(m.db.hgetall(creditKey))
+	m.db.del(creditKey)
+	return nil
+}
+
+func (m *MemoryClient) writeImmatureDebits(credits map[string]string) {
+	totals := make(map[string]*big.Int)
+	for field, amountString := range credits {
+		login, token := splitToken(field)
+		amount, _ := parseWei(amountString)
+		addWei(totals, token, amount)
+		m.db.hincrbig(m.formatKey("miners", login), withToken("immature", token), neg(amount))
+	}
+	for token, total := range totals {
+		m.db.hincrbig(m.formatKey("finances"), withToken("immature", token), neg(total))
+	}
+}
+
+func (m *MemoryClient) WritePendingOrphans(blocks []*BlockData) error {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	var err error
+	for _, block := range blocks {
+		if e := m.writeImmatureBlock(block); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Like MULTI on Redis, a failed rename doesn't stop remaining writes
+func (m *MemoryClient) writeImmatureBlock(block *BlockData) error {
+	var err error
+	if block.Height != block.RoundHeight && !block.Solo {
+		err = m.db.rename(m.formatRound(block.RoundHeight, block.Nonce), m.formatRound(block.Height, block.Nonce))
+	}
+	m.db.zrem(m.formatKey("blocks", "candidates"), block.candidateKey)
+	m.db.zadd(m.formatKey("blocks", "immature"), float64(block.Height), block.key())
+	return err
+}
+
+func (m *MemoryClient) writeMaturedBlock(block *BlockData) {
+	m.db.del(m.formatRound(block.RoundHeight, block.Nonce))
+	m.db.zrem(m.formatKey("blocks", "immature"), block.immatureKey)
+	m.db.zadd(m.formatKey("blocks", "matured"), float64(block.Height), block.key())
+	m.db.zadd(m.formatKey("tsblocks", "matured"), float64(block.Timestamp), block.keys())
+}
+
+func (m *MemoryClient) IsMinerExists(login string) (bool, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+	return m.db.exists(m.formatKey("miners", login)), nil
+}
+
+func (m *MemoryClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	stats := make(map[string]interface{})
+	miner := m.db.hgetall(m.formatKey("miners", login))
+	stats["stats"] = convertStringMap(miner)
+	stats["tokens"] = convertTokenBalances(miner)
+	stats["payments"] = convertPaymentsResults(m.db.zrevrange(m.formatKey("payments", login), 0, maxPayments-1), false)
+	stats["paymentsTotal"] = m.db.zcard(m.formatKey("payments", login))
+	roundShares, _ := strconv.ParseInt(m.db.hash(m.formatKey("shares", "roundCurrent"), false)[login], 10, 64)
+	stats["roundShares"] = roundShares
+	return stats, nil
+}
+
+func (m *MemoryClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+	total := m.db.zremBelow(m.formatKey("hashrate"), float64(now-int64(window/time.Second)))
+	prefix := m.formatKey("hashrate") + ":"
+	for key := range m.db.zsets {
+		if strings.HasPrefix(key, prefix) {
+			total += m.db.zremBelow(key, float64(now-int64(largeWindow/time.Second)))
+		}
+	}
+	return total, nil
+}
+
+func (m *MemoryClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	window := int64(smallWindow / time.Second)
+	stats := make(map[string]interface{})
+	now := util.MakeTimestamp() / 1000
+
+	hashrateList := make([]map[string]interface{}, 24, 24)
+	for i := int64(0); i < 24; i++ {
+		timestamp := now - (i+1)*3600
+		rows := m.db.zrangeByScore(m.formatKey("hashrate"), float64(timestamp), float64(timestamp+3600))
+		totalHashrateTemp, _ := convertMinersStats(window/24, rows)
+		value := make(map[string]interface{})
+		value["timestamp"] = fmt.Sprintf("%v", timestamp)
+		value["hashrate"] = fmt.Sprintf("%v", totalHashrateTemp)
+		hashrateList[i] = value
+	}
+	stats["hashrateList"] = hashrateList
+
+	m.db.zremBelow(m.formatKey("hashrate"), float64(now-window))
+	stats["stats"] = convertStringMap(m.db.hgetall(m.formatKey("stats")))
+	stats["candidates"] = convertCandidateResults(m.db.zrevrange(m.formatKey("blocks", "candidates"), 0, -1))
+	stats["candidatesTotal"] = m.db.zcard(m.formatKey("blocks", "candidates"))
+	immature := convertBlockResults(m.db.zrevrange(m.formatKey("blocks", "immature"), 0, -1))
+	rootIndex := convertRootIndex(m.db.hgetall(m.formatKey("roots")))
+	setRootConfirmations(immature, rootIndex, m.getRootConfirmations(blockHashes(immature)))
+	stats["roots"] = rootIndex
+	stats["immature"] = immature
+	stats["immatureTotal"] = m.db.zcard(m.formatKey("blocks", "immature"))
+	stats["matured"] = convertBlockResults(m.db.zrevrange(m.formatKey("blocks", "matured"), 0, maxBlocks-1))
+	stats["maturedTotal"] = m.db.zcard(m.formatKey("blocks", "matured"))
+	stats["payments"] = convertPaymentsResults(m.db.zrevrange(m.formatKey("payments", "all"), 0, maxPayments-1), true)
+	stats["paymentsTotal"] = m.db.zcard(m.formatKey("payments", "all"))
+	stats["tokens"] = convertTokenBalances(m.db.hgetall(m.formatKey("finances")))
+	totalHashrate, miners := convertMinersStats(window, m.db.zrange(m.formatKey("hashrate")))
+	setMinersStats(stats, totalHashrate, miners)
+	return stats, nil
+}
+
+func (m *MemoryClient) CollectProfits(login string) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	stats := make(map[string]interface{})
+	now := util.MakeTimestamp() / 1000
+	profitList := make([]map[string]interface{}, 24, 24)
+	for i := int64(0); i < 24; i++ {
+		timestamp := now - (i+1)*3600
+		rows := m.db.zrangeByScore(m.formatKey("tsblocks", "matured"), float64(timestamp), float64(timestamp+3600))
+		total, _ := convertMinerProfit(rows, login)
+		value := make(map[string]interface{})
+		value["timestamp"] = fmt.Sprintf("%v", timestamp)
+		value["profit"] = total
+		profitList[i] = value
+	}
+	stats["profitList"] = profitList
+	return stats, nil
+}
+
+func (m *MemoryClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	smallWindow := int64(sWindow / time.Second)
+	largeWindow := int64(lWindow / time.Second)
+	stats := make(map[string]interface{})
+	now := util.MakeTimestamp() / 1000
+
+	hashrateList := make([]map[string]interface{}, 24, 24)
+	for i := int64(0); i < 24; i++ {
+		timeTemp := now - (i+1)*3600
+		rows := m.db.zrangeByScore(m.formatKey("hashrate", login), float64(timeTemp), float64(timeTemp+3600))
+		value := make(map[string]interface{})
+		value["timestamp"] = fmt.Sprintf("%v", timeTemp)
+		value["hashrate"] = fmt.Sprintf("%v", hourlyWorkersHashrate(smallWindow, rows))
+		hashrateList[i] = value
+	}
+
+	m.db.zremBelow(m.formatKey("hashrate", login), float64(now-largeWindow))
+	workers := convertWorkersStats(smallWindow, m.db.zrange(m.formatKey("hashrate", login)))
+	reported := m.db.hgetall(m.formatKey("reported", login))
+
+	bucket := now - now%shareStatsBucket
+	rows := make([]map[string]string, shareStatsBuckets)
+	for i := range rows {
+		rows[i] = m.db.hgetall(m.formatKey("sharestats", login, bucket-int64(i)*shareStatsBucket))
+	}
+	workerShares, sharesList := convertShareStats(bucket, rows)
+	setWorkersStats(stats, login, now, smallWindow, largeWindow, workers, reported, workerShares)
+	stats["hashrateList"] = hashrateList
+	stats["sharesList"] = sharesList
+	return stats, nil
+}
+
+func (m *MemoryClient) CollectMinerBlockStats(login string, maxBlocks int64) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	stats := make(map[string]interface{})
+	_, matured := convertMinerProfit(m.db.zrevrange(m.formatKey("tsblocks", "matured"), 0, maxBlocks-1), login)
+	stats["minerBlockList"] = matured
+	stats["minerBlockTotal"] = len(matured)
+	return stats, nil
+}
+
+func (m *MemoryClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	max := int64(windows[len(windows)-1])
+	blocks := convertBlockResults(
+		m.db.zrevrange(m.formatKey("blocks", "immature"), 0, -1),
+		m.db.zrevrange(m.formatKey("blocks", "matured"), 0, max-1),
+	)
+	return calcLuckStats(blocks, windows), nil
+}
+
+func (m *MemoryClient) GetMills(smallWindow time.Duration) (map[string]Miner, error) {
+	m.db.Lock()
+	defer m.db.Unlock()
+
+	window := int64(smallWindow / time.Second)
+	_, miners := convertMinersStatsById(window, m.db.zrange(m.formatKey("hashrate")))
+	return miners, nil
+}
+
+// Drops key if its TTL passed, must be called before every access
+func (db *memoryDB) evict(key string) {
+	if at, ok := db.expires[key]; ok && at <= util.MakeTimestamp() {
+		db.del(key)
+	}
+}
+
+func (db *memoryDB) expire(key string, d time.Duration) {
+	if db.exists(key) {
+		db.expires[key] = util.MakeTimestamp() + int64(d/time.Millisecond)
+	}
+}
+
+func (db *memoryDB) exists(key string) bool {
+	db.evict(key)
+	if _, ok := db.strings[key]; ok {
+		return true
+	}
+	return db.hashes[key] != nil || db.zsets[key] != nil || db.lists[key] != nil || db.sets[key] != nil
+}
+
+func (db *memoryDB) del(key string) {
+	delete(db.strings, key)
+	delete(db.hashes, key)
+	delete(db.zsets, key)
+	delete(db.lists, key)
+	delete(db.sets, key)
+	delete(db.expires, key)
+}
+
+func (db *memoryDB) rename(src, dst string) error {
+	if !db.exists(src) {
+		return fmt.Errorf("ERR no such key")
+	}
+	db.del(dst)
+	if v, ok := db.strings[src]; ok {
+		db.strings[dst] = v
+	}
+	if v := db.hashes[src]; v != nil {
+		db.hashes[dst] = v
+	}
+	if v := db.zsets[src]; v != nil {
+		db.zsets[dst] = v
+	}
+	if v := db.lists[src]; v != nil {
+		db.lists[dst] = v
+	}
+	if v := db.sets[src]; v != nil {
+		db.sets[dst] = v
+	}
+	if v, ok := db.expires[src]; ok {
+		db.expires[dst] = v
+	}
+	db.del(src)
+	return nil
+}
+
+func (db *memoryDB) get(key string) string {
+	db.evict(key)
+	return db.strings[key]
+}
+
+func (db *memoryDB) set(key, value string) {
+	db.del(key)
+	db.strings[key] = value
+}
+
+func (db *memoryDB) setnx(key, value string) bool {
+	if db.exists(key) {
+		return false
+	}
+	db.strings[key] = value
+	return true
+}
+
+// Returns nil if hash doesn't exist and create is false
+func (db *memoryDB) hash(key string, create bool) map[string]string {
+	db.evict(key)
+	h := db.hashes[key]
+	if h == nil && create {
+		h = make(map[string]string)
+		db.hashes[key] = h
+	}
+	return h
+}
+
+func (db *memoryDB) hset(key, field, value string) {
+	db.hash(key, true)[field] = value
+}
+
+func (db *memoryDB) hsetnx(key, field, value string) {
+	h := db.hash(key, true)
+	if _, ok := h[field]; !ok {
+		h[field] = value
+	}
+}
+
+func (db *memoryDB) hdel(key, field string) {
+	if h := db.hash(key, false); h != nil {
+		delete(h, field)
+		if len(h) == 0 {
+			db.del(key)
+		}
+	}
+}
+
+func (db *memoryDB) hincrby(key, field string, n int64) int64 {
+	h := db.hash(key, true)
+	v, _ := strconv.ParseInt(h[field], 10, 64)
+	v += n
+	h[field] = strconv.FormatInt(v, 10)
+	return v
+}
+
+func (db *memoryDB) hincrbig(key, field string, n *big.Int) {
+	h := db.hash(key, true)
+	v, _ := parseWei(orZero(h[field]))
+	h[field] = v.Add(v, n).String()
+}
+
+func orZero(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func (db *memoryDB) hgetall(key string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range db.hash(key, false) {
+		result[k] = v
+	}
+	return result
+}
+
+func (db *memoryDB) zset(key string, create bool) map[string]float64 {
+	db.evict(key)
+	z := db.zsets[key]
+	if z == nil && create {
+		z = make(map[string]float64)
+		db.zsets[key] = z
+	}
+	return z
+}
+
+// Returns true if member is new
+func (db *memoryDB) zadd(key string, score float64, member string) bool {
+	z := db.zset(key, true)
+	_, ok := z[member]
+	z[member] = score
+	return !ok
+}
+
+func (db *memoryDB) zincrby(key string, n float64, member string) {
+	db.zset(key, true)[member] += n
+}
+
+func (db *memoryDB) zrem(key, member string) {
+	if z := db.zset(key, false); z != nil {
+		delete(z, member)
+		if len(z) == 0 {
+			db.del(key)
+		}
+	}
+}
+
+func (db *memoryDB) zcard(key string) int64 {
+	return int64(len(db.zset(key, false)))
+}
+
+// Members ordered by score then lexicographically, as Redis does
+func (db *memoryDB) zrange(key string) []redis.Z {
+	z := db.zset(key, false)
+	rows := make([]redis.Z, 0, len(z))
+	for member, score := range z {
+		rows = append(rows, redis.Z{Score: score, Member: member})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Score != rows[j].Score {
+			return rows[i].Score < rows[j].Score
+		}
+		return rows[i].Member.(string) < rows[j].Member.(string)
+	})
+	return rows
+}
+
+// Inclusive on both ends
+func (db *memoryDB) zrangeByScore(key string, min, max float64) []redis.Z {
+	var result []redis.Z
+	for _, v := range db.zrange(key) {
+		if v.Score >= min && v.Score <= max {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Same indexing as ZREVRANGE, negative stop counts from the end
+func (db *memoryDB) zrevrange(key string, start, stop int64) []redis.Z {
+	rows := db.zrange(key)
+	n := int64(len(rows))
+	if stop < 0 {
+		stop += n
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	var result []redis.Z
+	for i := start; i <= stop; i++ {
+		result = append(result, rows[n-1-i])
+	}
+	return result
+}
+
+// Removes members with score strictly below max
+func (db *memoryDB) zremBelow(key string, max float64) int64 {
+	var n int64
+	for member, score := range db.zset(key, false) {
+		if score < max {
+			db.zrem(key, member)
+			n++
+		}
+	}
+	return n
+}
+
+func (db *memoryDB) zremAbove(key string, min float64) int64 {
+	var n int64
+	for member, score := range db.zset(key, false) {
+		if score > min {
+			db.zrem(key, member)
+			n++
+		}
+	}
+	return n
+}
+
+// Keeps only size members with highest scores
+func (db *memoryDB) zkeepLast(key string, size int64) {
+	rows := db.zrange(key)
+	for i := int64(0); i < int64(len(rows))-size; i++ {
+		db.zrem(key, rows[i].Member.(string))
+	}
+}
+
+func (db *memoryDB) lpush(key, value string) {
+	db.evict(key)
+	db.lists[key] = append([]string{value}, db.lists[key]...)
+}
+
+func (db *memoryDB) ltrim(key string, size int) {
+	if l := db.lists[key]; len(l) > size {
+		db.lists[key] = l[:size]
+	}
+}
+
+// First n elements
+func (db *memoryDB) lrange(key string, n int64) []string {
+	db.evict(key)
+	l := db.lists[key]
+	if n < int64(len(l)) {
+		l = l[:n]
+	}
+	return append([]string(nil), l...)
+}
+
+func (db *memoryDB) sadd(key, member string) {
+	db.evict(key)
+	if db.sets[key] == nil {
+		db.sets[key] = make(map[string]struct{})
+	}
+	db.sets[key][member] = struct{}{}
+}
+
+func (db *memoryDB) smembers(key string) []string {
+	db.evict(key)
+	result := []string{}
+	for member := range db.sets[key] {
+		result = append(result, member)
+	}
+	return result
+}
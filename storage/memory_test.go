@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+func TestMemoryWriteShareCheckExist(t *testing.T) {
+	m := NewMemoryClient("test")
+
+	exist, _ := m.WriteShare("x", "x", nil, nil, []string{"0x0", "0x0", "0x0"}, 10, 1008, time.Hour)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = m.WriteShare("z", "x", nil, nil, []string{"0x0", "0x0", "0x0"}, 10, 1010, time.Hour)
+	if !exist {
+		t.Error("PoW must exist")
+	}
+	exist, _ = m.WriteShare("x", "x", nil, nil, []string{"0x0", "0x0", "0x0"}, 10, 1025, time.Hour)
+	if exist {
+		t.Error("PoW must not exist")
+	}
+}
+
+func TestMemoryBlockLifecycle(t *testing.T) {
+	m := NewMemoryClient("test")
+
+	m.WriteShare("a", "0", nil, nil, []string{"0x1", "0x0", "0x0"}, 10, 100, time.Hour)
+	m.WriteBlock("b", "0", nil, nil, []string{"0x2", "0x0", "0x0"}, 30, 1000, 100, time.Hour)
+
+	candidates, _ := m.GetCandidates(100)
+	if len(candidates) != 1 || candidates[0].TotalShares != 40 || candidates[0].Coinbase != "b" {
+		t.Fatalf("Invalid candidates %v", candidates)
+	}
+	shares, _ := m.GetRoundShares(100, "0x2")
+	if shares["a"] != 10 || shares["b"] != 30 {
+		t.Errorf("Invalid round shares %v", shares)
+	}
+
+	block := candidates[0]
+	block.Hash = "0xabc"
+	block.Reward = big.NewInt(4e18)
+	m.WriteImmatureBlock(block, TokenRewards{util.DefaultToken: {"a": big.NewInt(1), "b": big.NewInt(3)}})
+	if c, _ := m.GetCandidates(100); len(c) != 0 {
+		t.Error("Candidate must be removed")
+	}
+	immature, _ := m.GetImmatureBlocks(100)
+	if len(immature) != 1 {
+		t.Fatalf("Invalid immature blocks %v", immature)
+	}
+
+	immature[0].Reward = block.Reward
+	m.WriteMaturedBlock(immature[0], TokenRewards{util.DefaultToken: {"a": big.NewInt(1), "b": big.NewInt(3)}})
+	if b, _ := m.GetImmatureBlocks(100); len(b) != 0 {
+		t.Error("Immature block must be removed")
+	}
+	if avg, _ := m.GetAverageReward(10); avg == nil || avg.Cmp(block.Reward) != 0 {
+		t.Errorf("Invalid average reward %v", avg)
+	}
+}
+
+func TestMemoryPayoutPlan(t *testing.T) {
+	m := NewMemoryClient("test")
+	m.db.hset(m.formatKey("miners", "a"), "balance", "100")
+
+	plan := &PayoutPlan{Id: "1", Payments: []*PlannedPayment{{Address: "a", Amount: big.NewInt(60), State: PaymentNew}}}
+	if err := m.CreatePayoutPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreatePayoutPlan(plan); err == nil {
+		t.Error("Second plan must not acquire lock")
+	}
+	if balance, _ := m.GetBalance("a", util.DefaultToken); balance.Int64() != 40 {
+		t.Errorf("Invalid balance %v", balance)
+	}
+
+	p, _ := m.GetPayoutPlan()
+	if p == nil || len(p.Payments) != 1 || p.Payments[0].Amount.Int64() != 60 {
+		t.Fatalf("Invalid plan %v", p)
+	}
+	p.Payments[0].State = PaymentFailed
+	m.FailPlannedPayment(p.Id, p.Payments[0])
+	m.FinishPayoutPlan(p.Id)
+
+	if balance, _ := m.GetBalance("a", util.DefaultToken); balance.Int64() != 100 {
+		t.Errorf("Balance must be credited back, got %v", balance)
+	}
+	if locked, _ := m.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+	if p, _ := m.GetPayoutPlan(); p != nil {
+		t.Error("Plan must be finished")
+	}
+}
+
+func TestMemoryPlannedPaymentLifecycle(t *testing.T) {
+	m := NewMemoryClient("test")
+	m.db.hset(m.formatKey("miners", "a"), "balance", "100")
+
+	plan := &PayoutPlan{Id: "1", Payments: []*PlannedPayment{{Address: "a", Amount: big.NewInt(60), Nonce: 7, State: PaymentNew}}}
+	if err := m.CreatePayoutPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := m.GetPayoutPlan()
+	payment := p.Payments[0]
+	payment.TxHash = "0x2"
+	payment.State = PaymentPending
+	payment.SentAt = 1500000000
+	payment.GasPrice = big.NewInt(1100000000)
+	payment.Replaced = []string{"0x0", "0x1"}
+	m.UpdatePlannedPayment(p.Id, payment)
+
+	p, _ = m.GetPayoutPlan()
+	payment = p.Payments[0]
+	if payment.State != PaymentPending || payment.SentAt != 1500000000 || payment.GasPrice.Int64() != 1100000000 || payment.Nonce != 7 {
+		t.Errorf("Invalid payment %+v", payment)
+	}
+	if hashes := payment.TxHashes(); len(hashes) != 3 || hashes[0] != "0x2" || hashes[2] != "0x0" {
+		t.Errorf("Invalid tx hashes %v", hashes)
+	}
+	if p.Done() {
+		t.Error("Plan with pending payment must not be done")
+	}
+	if (&PayoutPlan{Payments: []*PlannedPayment{{State: PaymentUnresolved}}}).Done() {
+		t.Error("Plan with unresolved payment must not be done")
+	}
+
+	payment.State = PaymentDropped
+	m.FailPlannedPayment(p.Id, payment)
+	if balance, _ := m.GetBalance("a", util.DefaultToken); balance.Int64() != 100 {
+		t.Errorf("Dropped payment must be credited back, got %v", balance)
+	}
+	p, _ = m.GetPayoutPlan()
+	if !p.Done() {
+		t.Error("Plan with dropped payment must be done")
+	}
+	m.FinishPayoutPlan(p.Id)
+	if !m.db.exists(m.formatKey("payments", "plan", p.Id)) {
+		t.Error("Finished plan must be kept")
+	}
+}
+
+func TestMemoryBalanceInWei(t *testing.T) {
+	m := NewMemoryClient("test")
+	credit, _ := new(big.Int).SetString("50000000000000000000", 10)
+
+	m.WriteShare("a", "0", nil, credit, []string{"0x1", "0x0", "0x0"}, 10, 100, time.Hour)
+	m.WriteShare("a", "0", nil, credit, []string{"0x2", "0x0", "0x0"}, 10, 100, time.Hour)
+	if balance, _ := m.GetBalance("a", util.DefaultToken); balance.String() != "100000000000000000000" {
+		t.Errorf("Invalid balance %v", balance)
+	}
+
+	m.UpdateBalance("a", util.DefaultToken, credit)
+	if balance, _ := m.GetBalance("a", util.DefaultToken); balance.Cmp(credit) != 0 {
+		t.Errorf("Invalid balance %v", balance)
+	}
+	if pending := m.GetPendingPayments(); len(pending) != 1 || pending[0].Amount.Cmp(credit) != 0 {
+		t.Errorf("Invalid pending payments %v", pending)
+	}
+}
+
+func TestMemoryTokenRewards(t *testing.T) {
+	m := NewMemoryClient("test")
+
+	m.WriteBlock("a", "0", nil, nil, []string{"0x1", "0x0", "0x0"}, 10, 1000, 100, time.Hour)
+	candidates, _ := m.GetCandidates(100)
+	block := candidates[0]
+	block.Hash = "0xabc"
+	block.Reward = big.NewInt(4e18)
+	block.TokenRewards = map[string]*big.Int{"QI": big.NewInt(7e18)}
+	rewards := TokenRewards{util.DefaultToken: {"a": big.NewInt(4e18)}, "QI": {"a": big.NewInt(7e18)}}
+
+	m.WriteImmatureBlock(block, rewards)
+	stats, _ := m.GetMinerStats("a", 10)
+	tokens := stats["tokens"].(map[string]map[string]string)
+	if tokens["QI"]["immature"] != "7000000000000000000" || tokens[util.DefaultToken]["immature"] != "4000000000000000000" {
+		t.Errorf("Invalid immature balances %v", tokens)
+	}
+
+	immature, _ := m.GetImmatureBlocks(100)
+	immature[0].Reward = block.Reward
+	immature[0].TokenRewards = block.TokenRewards
+	m.WriteMaturedBlock(immature[0], rewards)
+	if balance, _ := m.GetBalance("a", "QI"); balance.Int64() != 7e18 {
+		t.Errorf("Invalid QI balance %v", balance)
+	}
+	stats, _ = m.GetMinerStats("a", 10)
+	tokens = stats["tokens"].(map[string]map[string]string)
+	if tokens["QI"]["immature"] != "0" {
+		t.Errorf("QI immature balance must be debited, got %v", tokens["QI"])
+	}
+
+	plan := &PayoutPlan{Id: "1", Payments: []*PlannedPayment{{Address: "a", Token: "QI", Amount: big.NewInt(5e18), State: PaymentNew}}}
+	if err := m.CreatePayoutPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := m.GetPayoutPlan()
+	if p == nil || p.Payments[0].Token != "QI" {
+		t.Fatalf("Invalid plan %v", p)
+	}
+	if balance, _ := m.GetBalance("a", "QI"); balance.Int64() != 2e18 {
+		t.Errorf("Invalid QI balance %v", balance)
+	}
+	p.Payments[0].State = PaymentConfirmed
+	m.WritePlannedPayment(p.Id, p.Payments[0])
+	m.FinishPayoutPlan(p.Id)
+
+	stats, _ = m.GetMinerStats("a", 10)
+	payments := stats["payments"].([]map[string]interface{})
+	if len(payments) != 1 || payments[0]["token"] != "QI" || payments[0]["amount"] != "5000000000000000000" {
+		t.Errorf("Invalid payments %v", payments)
+	}
+}
+
+func TestMemoryRootIndex(t *testing.T) {
+	m := NewMemoryClient("test")
+	if index, _ := m.GetRootIndex(); index != nil {
+		t.Fatalf("Root index must be empty, got %v", index)
+	}
+
+	m.WriteRootBlock(&RootIndex{Height: 10, Hash: "0xa", MinorHeight: 100}, []string{"0xAB"}, 5)
+	m.WriteRootBlock(&RootIndex{Height: 11, Hash: "0xb", MinorHeight: 101}, []string{"0xcd"}, 5)
+	confirmations, _ := m.GetRootConfirmations([]string{"0xab", "0xcd", "0xef"})
+	if len(confirmations) != 2 || confirmations["0xab"] != 10 || confirmations["0xcd"] != 11 {
+		t.Errorf("Invalid root confirmations %v", confirmations)
+	}
+
+	if indexed, _ := m.GetIndexedRoot(10); indexed == nil || indexed.Hash != "0xa" || indexed.MinorHeight != 100 {
+		t.Errorf("Invalid indexed root block %v", indexed)
+	}
+
+	m.RewindRootIndex(&RootIndex{Height: 10, Hash: "0xa", MinorHeight: 100})
+	if index, _ := m.GetRootIndex(); index == nil || index.Height != 10 || index.Hash != "0xa" || index.MinorHeight != 100 {
+		t.Errorf("Invalid root index %v", index)
+	}
+	if indexed, _ := m.GetIndexedRoot(11); indexed != nil {
+		t.Errorf("Replaced root block must be dropped, got %v", indexed)
+	}
+	if confirmations, _ := m.GetRootConfirmations([]string{"0xcd"}); len(confirmations) != 0 {
+		t.Errorf("Confirmation by replaced root block must be dropped, got %v", confirmations)
+	}
+
+	m.WriteRootBlock(&RootIndex{Height: 16, Hash: "0xc", MinorHeight: 102}, nil, 5)
+	if confirmations, _ := m.GetRootConfirmations([]string{"0xab"}); len(confirmations) != 0 {
+		t.Errorf("Confirmation out of window must be dropped, got %v", confirmations)
+	}
+	if indexed, _ := m.GetIndexedRoot(10); indexed != nil {
+		t.Errorf("Root block out of window must be dropped, got %v", indexed)
+	}
+}
+
+func TestMemoryNamespace(t *testing.T) {
+	m := NewMemoryClient("test")
+	s0, s1 := m.Namespace("0"), m.Namespace("1")
+
+	s0.WriteShare("a", "0", nil, nil, []string{"0x1", "0x0", "0x0"}, 10, 100, time.Hour)
+	if payees, _ := s0.GetPayees(); len(payees) != 1 || payees[0] != "a" {
+		t.Errorf("Invalid payees %v", payees)
+	}
+	if payees, _ := s1.GetPayees(); len(payees) != 0 {
+		t.Errorf("Shards must not share miners, got %v", payees)
+	}
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Value of units key once money is kept in Wei
+const unitsWei = "wei"
+
+func (r *RedisClient) Migrated() (bool, error) {
+	units, err := r.client.Get(r.formatKey("units")).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return units == unitsWei, nil
+}
+
+// Converts balances, credits and payments written in Shannon by older versions to Wei.
+// Runs once per namespace, all keys are rewritten in a single transaction with units marker.
+func (r *RedisClient) Migrate() error {
+	unitsKey := r.formatKey("units")
+	tx, err := r.client.Watch(unitsKey)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	units, err := tx.Get(unitsKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if units == unitsWei {
+		return nil
+	}
+
+	var writes []func(tx *redis.Multi)
+	add := func(w []func(tx *redis.Multi), err error) error {
+		writes = append(writes, w...)
+		return err
+	}
+
+	keys, err := r.scanKeys(r.formatKey("miners", "*"))
+	if err != nil {
+		return err
+	}
+	keys = append(keys, r.formatKey("finances"))
+	for _, key := range keys {
+		if err := add(r.migrateHash(key, weiFieldToWei)); err != nil {
+			return err
+		}
+	}
+
+	keys, err = r.scanKeys(r.formatKey("credits", "*"))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		// Block rewards log is in Wei already
+		if key == r.formatKey("credits", "all") {
+			continue
+		}
+		if err := add(r.migrateHash(key, anyFieldToWei)); err != nil {
+			return err
+		}
+	}
+
+	keys, err = r.scanKeys(r.formatKey("payments", "*"))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		switch {
+		case key == r.formatKey("payments", "plan"):
+			// Id of current payout plan
+			continue
+		case key == r.formatKey("payments", "lock"):
+			err = add(r.migrateString(key))
+		case strings.HasPrefix(key, r.formatKey("payments", "plan")+":"):
+			// "amount:nonce:txHash:state"
+			err = add(r.migrateHash(key, planFieldToWei))
+		default:
+			// payments:all, payments:pending and payments:<login>, amount is the last field
+			err = add(r.migrateZSet(key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(func() error {
+		for _, w := range writes {
+			w(tx)
+		}
+		tx.Set(unitsKey, unitsWei, 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(writes) > 0 {
+		log.Printf("Converted %v Shannon amounts in %s to Wei", len(writes), r.prefix)
+	}
+	return nil
+}
+
+func (r *RedisClient) scanKeys(pattern string) ([]string, error) {
+	var result []string
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+		if c == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisClient) migrateHash(key string, convert func(field, value string) (string, bool, error)) ([]func(tx *redis.Multi), error) {
+	var writes []func(tx *redis.Multi)
+	values, err := r.client.HGetAllMap(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range values {
+		converted, ok, err := convert(field, value)
+		if err != nil {
+			return nil, fmt.Errorf("Can't convert %s %s: %v", key, field, err)
+		}
+		if !ok {
+			continue
+		}
+		field := field
+		writes = append(writes, func(tx *redis.Multi) {
+			tx.HSet(key, field, converted)
+		})
+	}
+	return writes, nil
+}
+
+func (r *RedisClient) migrateZSet(key string) ([]func(tx *redis.Multi), error) {
+	var writes []func(tx *redis.Multi)
+	rows, err := r.client.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		member := row.Member.(string)
+		converted, err := lastFieldToWei(member)
+		if err != nil {
+			return nil, fmt.Errorf("Can't convert %s %s: %v", key, member, err)
+		}
+		score := row.Score
+		writes = append(writes, func(tx *redis.Multi) {
+			tx.ZRem(key, member)
+			tx.ZAdd(key, redis.Z{Score: score, Member: converted})
+		})
+	}
+	return writes, nil
+}
+
+func (r *RedisClient) migrateString(key string) ([]func(tx *redis.Multi), error) {
+	value, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	converted, err := lastFieldToWei(value)
+	if err != nil {
+		return nil, fmt.Errorf("Can't convert %s: %v", key, err)
+	}
+	return []func(tx *redis.Multi){func(tx *redis.Multi) {
+		tx.Set(key, converted, 0)
+	}}, nil
+}
+
+func weiFieldToWei(field, value string) (string, bool, error) {
+	if !weiFields[field] {
+		return "", false, nil
+	}
+	converted, err := shannonToWei(value)
+	return converted, true, err
+}
+
+func anyFieldToWei(field, value string) (string, bool, error) {
+	converted, err := shannonToWei(value)
+	return converted, true, err
+}
+
+func planFieldToWei(field, value string) (string, bool, error) {
+	fields := strings.Split(value, ":")
+	amount, err := shannonToWei(fields[0])
+	fields[0] = amount
+	return strings.Join(fields, ":"), true, err
+}
+
+func lastFieldToWei(value string) (string, error) {
+	fields := strings.Split(value, ":")
+	amount, err := shannonToWei(fields[len(fields)-1])
+	fields[len(fields)-1] = amount
+	return strings.Join(fields, ":"), err
+}
+
+func shannonToWei(value string) (string, error) {
+	amount, err := parseWei(value)
+	if err != nil {
+		return "", err
+	}
+	return amount.Mul(amount, util.Shannon).String(), nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/sammy007/open-ethereum-pool/util"
 	"gopkg.in/redis.v3"
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +21,8 @@ type Config struct {
 type RedisClient struct {
 	client *redis.Client
 	prefix string
+	// Number of last shares kept in a share log for PPLNS, 0 disables logging
+	shareLogSize int64
 }
 
 type BlockData struct {
@@ -39,14 +42,17 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
+	ShareSeq       int64    `json:"-"`
 	candidateKey   string
 	immatureKey    string
 	Coinbase       string `json:"coinbase"`
-}
-
-func (b *BlockData) RewardInShannon() int64 {
-	reward := new(big.Int).Div(b.Reward, util.Shannon)
-	return reward.Int64()
+	// Found on solo stratum, whole reward goes to finder
+	Solo bool `json:"solo"`
+	// Coinbase of native tokens other than default one, in Wei
+	TokenRewards map[string]*big.Int `json:"-"`
+	// Root block which confirmed this block and number of root blocks confirming it so far
+	RootHeight        int64 `json:"rootHeight,omitempty"`
+	RootConfirmations int64 `json:"rootConfirmations,omitempty"`
 }
 
 func (b *BlockData) serializeHash() string {
@@ -62,7 +68,7 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Coinbase)
+	return join(b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward, b.Coinbase, b.Solo)
 }
 
 func (b *BlockData) keys() string {
@@ -77,10 +83,46 @@ type Miner struct {
 	MinerId   string `json:"minerId"`
 }
 
+// Outcomes of submitted shares, counted per worker in hourly buckets
+const (
+	ShareAccepted  = "accepted"
+	ShareStale     = "stale"
+	ShareDuplicate = "duplicate"
+	ShareInvalid   = "invalid"
+
+	shareStatsBucket  = 3600
+	shareStatsBuckets = 24
+)
+
+type ShareStats struct {
+	Accepted  int64 `json:"accepted"`
+	Stale     int64 `json:"stale"`
+	Duplicate int64 `json:"duplicate"`
+	Invalid   int64 `json:"invalid"`
+}
+
+func (s *ShareStats) add(status string, n int64) {
+	switch status {
+	case ShareAccepted:
+		s.Accepted += n
+	case ShareStale:
+		s.Stale += n
+	case ShareDuplicate:
+		s.Duplicate += n
+	case ShareInvalid:
+		s.Invalid += n
+	}
+}
+
 type Worker struct {
 	Miner
 	TotalHR  int64  `json:"hr2"`
 	WorkerId string `json:"workerId"`
+	// Hashrate reported by mining software, compare with effective one to spot bad rigs
+	ReportedHR int64  `json:"reportedHr"`
+	ClientId   string `json:"clientId,omitempty"`
+	// Shares submitted within the last 24 hours
+	Shares ShareStats `json:"shares"`
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
@@ -93,6 +135,25 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 	return &RedisClient{client: client, prefix: prefix}
 }
 
+func (r *RedisClient) Close() error {
+	return r.client.Close()
+}
+
+// Returns client sharing the same connection pool with keys prefixed by namespace,
+// used to keep data of several shards in one Redis
+func (r *RedisClient) Namespace(ns string) Backend {
+	n := *r
+	n.prefix = join(r.prefix, ns)
+	return &n
+}
+
+// Number of last matured block rewards kept for FPPS average
+const maxRewardsLog = 1000
+
+func (r *RedisClient) SetShareLogSize(size int64) {
+	r.shareLogSize = size
+}
+
 func (r *RedisClient) Client() *redis.Client {
 	return r.client
 }
@@ -139,13 +200,47 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
 	return err
 }
 
+func (r *RedisClient) WriteShareStat(login, id, status string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	now := util.MakeTimestamp() / 1000
+	key := r.formatKey("sharestats", login, now-now%shareStatsBucket)
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(key, join(id, status), 1)
+		tx.Expire(key, time.Duration(shareStatsBucket*(shareStatsBuckets+1))*time.Second)
+		return nil
+	})
+	return err
+}
+
+// Hashrate reported by miner with eth_submitHashrate
+func (r *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	now := util.MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		tx.HSet(r.formatKey("reported", login), id, join(hashrate, clientId, now))
+		tx.Expire(r.formatKey("reported", login), expire)
+		return nil
+	})
+	return err
+}
+
 func (r *RedisClient) GetNodeStates() (map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
+	return convertNodeStates(cmd.Val()), nil
+}
+
+func convertNodeStates(raw map[string]string) map[string]interface{} {
 	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
+	for key, value := range raw {
 		parts := strings.Split(key, ":")
 		if val, ok := m[parts[0]]; ok {
 			val[parts[1]] = value
@@ -162,93 +257,96 @@ func (r *RedisClient) GetNodeStates() (map[string]interface{}, error) {
 		v = value
 		i++
 	}
-	return v, nil
+	return v
 }
 
-func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
-	// Sweep PoW backlog for previous blocks, we have 3 templates back in RAM
-	r.client.ZRemRangeByScore(r.formatKey("pow"), "-inf", fmt.Sprint("(", height-8))
-	val, err := r.client.ZAdd(r.formatKey("pow"), redis.Z{Score: float64(height), Member: strings.Join(params, ":")}).Result()
-	return val == 0, err
+// Credit is a PPS reward for a share in Wei, if balance is nil miner's balance is not overwritten by on-chain one
+func (r *RedisClient) WriteShare(login, id string, balance, credit *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	return r.writeShare(login, id, balance, credit, params, diff, 0, height, window, true, false)
 }
 
-func (r *RedisClient) WriteShare(login, id string, balance *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
-	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
-	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	ms := util.MakeTimestamp()
-	ts := ms / 1000
+func (r *RedisClient) WriteBlock(login, id string, balance, credit *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+	return r.writeShare(login, id, balance, credit, params, diff, roundDiff, height, window, true, true)
+}
 
-	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, balance, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
-		return nil
-	})
-	return false, err
+// Solo share doesn't count towards pool round, it's only accounted for hashrate
+func (r *RedisClient) WriteSoloShare(login, id string, balance *big.Int, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+	return r.writeShare(login, id, balance, nil, params, diff, 0, height, window, false, false)
 }
 
-func (r *RedisClient) WriteBlock(login, id string, balance *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
-	if err != nil {
-		return false, err
-	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
-	}
-	tx := r.client.Multi()
-	defer tx.Close()
+// Solo block keeps pool round untouched, candidate is paid to the finder only
+func (r *RedisClient) WriteSoloBlock(login, id string, balance *big.Int, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+	return r.writeShare(login, id, balance, nil, params, diff, roundDiff, height, window, false, true)
+}
 
+// Runs writeShareScript, returns true for a duplicate share, (nonce, powHash, mixDigest) pair exist
+func (r *RedisClient) writeShare(login, id string, balance, credit *big.Int, params []string, diff, roundDiff int64, height uint64, expire time.Duration, pool, block bool) (bool, error) {
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, balance, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
-		return nil
-	})
+	keys := []string{
+		r.formatKey("pow"),
+		r.formatKey("shares", "seq"),
+		r.formatKey("shares", "roundCurrent"),
+		r.formatKey("shares", "log"),
+		r.formatKey("hashrate"),
+		r.formatKey("hashrate", login),
+		r.formatKey("miners", login),
+		r.formatKey("finances"),
+		r.formatKey("stats"),
+		r.formatKey("finders"),
+		r.formatRound(int64(height), params[0]),
+		r.formatKey("blocks", "candidates"),
+	}
+	var bal string
+	if balance != nil {
+		bal = balance.String()
+	}
+	args := []string{
+		strconv.FormatUint(height, 10),
+		strings.Join(params, ":"),
+		login,
+		id,
+		strconv.FormatInt(diff, 10),
+		strconv.FormatInt(ms, 10),
+		strconv.FormatInt(ts, 10),
+		strconv.FormatInt(int64(expire/time.Millisecond), 10),
+		bal,
+		join(credit),
+		strconv.FormatInt(r.shareLogSize, 10),
+		join(pool),
+		join(block),
+		strconv.FormatInt(roundDiff, 10),
+	}
+	result, err := writeShareScript.Run(r.client, keys, args).Result()
 	if err != nil {
 		return false, err
-	} else {
-		sharesMap, _ := cmds[11].(*redis.StringStringMapCmd).Result()
-		totalShares := int64(0)
-		for _, v := range sharesMap {
-			n, _ := strconv.ParseInt(v, 10, 64)
-			totalShares += n
-		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares, login)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
 	}
-}
-
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, balance *big.Int, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
-	tx.HSet(r.formatKey("miners", login), "balance", balance.String())
+	exist, _ := result.(int64)
+	return exist == 1, nil
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
 	return join(r.prefix, join(args...))
 }
 
+// Adds signed amount in Wei to a hash field, queued in a transaction like HINCRBY
+func (r *RedisClient) hincrWei(tx *redis.Multi, key, field string, amount *big.Int) {
+	incrBigScript.Eval(tx, []string{key}, []string{field, amount.String()})
+}
+
+func parseWei(s string) (*big.Int, error) {
+	amount, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return new(big.Int), fmt.Errorf("invalid amount %q", s)
+	}
+	return amount, nil
+}
+
+func neg(amount *big.Int) *big.Int {
+	return new(big.Int).Neg(amount)
+}
+
 func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
@@ -291,7 +389,7 @@ func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertCandidateResults(cmd), nil
+	return convertCandidateResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
@@ -300,7 +398,96 @@ func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertBlockResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
+}
+
+// Nil if root chain was never indexed
+func (r *RedisClient) GetRootIndex() (*RootIndex, error) {
+	result, err := r.client.HGetAllMap(r.formatKey("roots")).Result()
+	if err != nil {
+		return nil, err
+	}
+	return convertRootIndex(result), nil
+}
+
+// Indexes minor blocks of pool shard included into root block at index height,
+// confirmations older than window root blocks are dropped
+func (r *RedisClient) WriteRootBlock(index *RootIndex, minorHashes []string, window int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	key := r.formatKey("roots", "confirmations")
+	chainKey := r.formatKey("roots", "chain")
+	height := strconv.FormatInt(index.Height, 10)
+	_, err := tx.Exec(func() error {
+		for _, hash := range minorHashes {
+			tx.ZAdd(key, redis.Z{Score: float64(index.Height), Member: strings.ToLower(hash)})
+		}
+		tx.ZRemRangeByScore(chainKey, height, height)
+		tx.ZAdd(chainKey, redis.Z{Score: float64(index.Height), Member: index.chainMember()})
+		r.writeRootIndex(tx, index)
+		tx.ZRemRangeByScore(key, "-inf", fmt.Sprint("(", index.Height-window))
+		tx.ZRemRangeByScore(chainKey, "-inf", fmt.Sprint("(", index.Height-window))
+		return nil
+	})
+	return err
+}
+
+// Drops confirmations by root blocks above index height after root chain reorganization
+func (r *RedisClient) RewindRootIndex(index *RootIndex) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.ZRemRangeByScore(r.formatKey("roots", "confirmations"), fmt.Sprint("(", index.Height), "+inf")
+		tx.ZRemRangeByScore(r.formatKey("roots", "chain"), fmt.Sprint("(", index.Height), "+inf")
+		r.writeRootIndex(tx, index)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetIndexedRoot(height int64) (*RootIndex, error) {
+	h := strconv.FormatInt(height, 10)
+	rows, err := r.client.ZRangeByScore(r.formatKey("roots", "chain"), redis.ZRangeByScore{Min: h, Max: h}).Result()
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return convertRootChain(rows[0]), nil
+}
+
+func (r *RedisClient) writeRootIndex(tx *redis.Multi, index *RootIndex) {
+	tx.HMSet(r.formatKey("roots"),
+		"height", strconv.FormatInt(index.Height, 10),
+		"hash", index.Hash,
+		"minorHeight", strconv.FormatInt(index.MinorHeight, 10))
+}
+
+// Heights of root blocks which included given minor blocks, unconfirmed blocks are omitted
+func (r *RedisClient) GetRootConfirmations(hashes []string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	if len(hashes) == 0 {
+		return result, nil
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, hash := range hashes {
+			tx.ZScore(r.formatKey("roots", "confirmations"), strings.ToLower(hash))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, hash := range hashes {
+		height, err := cmds[i].(*redis.FloatCmd).Result()
+		if err == nil {
+			result[strings.ToLower(hash)] = int64(height)
+		}
+	}
+	return result, nil
 }
 
 func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
@@ -317,6 +504,58 @@ func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int
 	return result, nil
 }
 
+// Walks share log back from seq until maxShares shares or maxDiff total difficulty is collected.
+// The last share is accounted partially to fit into maxDiff.
+func (r *RedisClient) GetShareWindow(seq, maxShares, maxDiff int64) (map[string]int64, error) {
+	result := make(map[string]int64)
+	var count, total int64
+	max := strconv.FormatInt(seq, 10)
+	batch := int64(10000)
+
+	for {
+		option := redis.ZRangeByScore{Min: "-inf", Max: max, Offset: 0, Count: batch}
+		cmd := r.client.ZRevRangeByScoreWithScores(r.formatKey("shares", "log"), option)
+		if cmd.Err() != nil {
+			return nil, cmd.Err()
+		}
+		rows := cmd.Val()
+		for _, v := range rows {
+			// "diff:login:seq"
+			fields := strings.Split(v.Member.(string), ":")
+			diff, _ := strconv.ParseInt(fields[0], 10, 64)
+			if maxDiff > 0 && total+diff > maxDiff {
+				diff = maxDiff - total
+			}
+			result[fields[1]] += diff
+			total += diff
+			count++
+			if (maxShares > 0 && count >= maxShares) || (maxDiff > 0 && total >= maxDiff) {
+				return result, nil
+			}
+		}
+		if int64(len(rows)) < batch {
+			break
+		}
+		max = fmt.Sprint("(", int64(rows[len(rows)-1].Score))
+	}
+	return result, nil
+}
+
+// Overwrites round shares, used to pay a block to a PPLNS window instead of its round
+func (r *RedisClient) ReplaceRoundShares(height int64, nonce string, shares map[string]int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.Del(r.formatRound(height, nonce))
+		for login, n := range shares {
+			tx.HIncrBy(r.formatRound(height, nonce), login, n)
+		}
+		return nil
+	})
+	return err
+}
+
 func (r *RedisClient) GetPayees() ([]string, error) {
 	payees := make(map[string]struct{})
 	var result []string
@@ -330,7 +569,7 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 			return nil, err
 		}
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
+			login := strings.TrimPrefix(row, r.formatKey("miners")+":")
 			payees[login] = struct{}{}
 		}
 		if c == 0 {
@@ -343,17 +582,18 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	return result, nil
 }
 
-func (r *RedisClient) GetBalance(login string) (int64, error) {
-	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
+// Balance of a token in Wei
+func (r *RedisClient) GetBalance(login, token string) (*big.Int, error) {
+	cmd := r.client.HGet(r.formatKey("miners", login), withToken("balance", token))
 	if cmd.Err() == redis.Nil {
-		return 0, nil
+		return new(big.Int), nil
 	} else if cmd.Err() != nil {
-		return 0, cmd.Err()
+		return nil, cmd.Err()
 	}
-	return cmd.Int64()
+	return parseWei(cmd.Val())
 }
 
-func (r *RedisClient) LockPayouts(login string, amount int64) error {
+func (r *RedisClient) LockPayouts(login string, amount *big.Int) error {
 	key := r.formatKey("payments", "lock")
 	result := r.client.SetNX(key, join(login, amount), 0).Val()
 	if !result {
@@ -380,98 +620,306 @@ func (r *RedisClient) IsPayoutsLocked() (bool, error) {
 }
 
 type PendingPayment struct {
-	Timestamp int64  `json:"timestamp"`
-	Amount    int64  `json:"amount"`
-	Address   string `json:"login"`
+	Timestamp int64    `json:"timestamp"`
+	Amount    *big.Int `json:"amount"`
+	Address   string   `json:"login"`
+	Token     string   `json:"token"`
 }
 
 func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
+	return convertPendingPayments(raw.Val())
+}
+
+func convertPendingPayments(raw []redis.Z) []*PendingPayment {
 	var result []*PendingPayment
-	for _, v := range raw.Val() {
-		// timestamp -> "address:amount"
-		payment := PendingPayment{}
+	for _, v := range raw {
+		// timestamp -> "address:amount[:token]"
+		payment := PendingPayment{Token: util.DefaultToken}
 		payment.Timestamp = int64(v.Score)
 		fields := strings.Split(v.Member.(string), ":")
 		payment.Address = fields[0]
-		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+		payment.Amount, _ = parseWei(fields[1])
+		if len(fields) > 2 {
+			payment.Token = fields[2]
+		}
 		result = append(result, &payment)
 	}
 	return result
 }
 
 // Deduct miner's balance for payment
-func (r *RedisClient) UpdateBalance(login string, amount int64) error {
+func (r *RedisClient) UpdateBalance(login, token string, amount *big.Int) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		r.debitBalance(tx, ts, login, token, amount)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) debitBalance(tx *redis.Multi, ts int64, login, token string, amount *big.Int) {
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("balance", token), neg(amount))
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("pending", token), amount)
+	r.hincrWei(tx, r.formatKey("finances"), withToken("balance", token), neg(amount))
+	r.hincrWei(tx, r.formatKey("finances"), withToken("pending", token), amount)
+	tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: withToken(join(login, amount), token)})
+}
+
+func (r *RedisClient) RollbackBalance(login, token string, amount *big.Int) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		r.rollbackBalance(tx, login, token, amount)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) rollbackBalance(tx *redis.Multi, login, token string, amount *big.Int) {
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("balance", token), amount)
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("pending", token), neg(amount))
+	r.hincrWei(tx, r.formatKey("finances"), withToken("balance", token), amount)
+	r.hincrWei(tx, r.formatKey("finances"), withToken("pending", token), neg(amount))
+	tx.ZRem(r.formatKey("payments", "pending"), withToken(join(login, amount), token))
+}
+
+func (r *RedisClient) WritePayment(login, token, txHash string, amount *big.Int) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
 	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+		r.writePayment(tx, ts, login, token, txHash, amount)
+		tx.Del(r.formatKey("payments", "lock"))
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) RollbackBalance(login string, amount int64) error {
+func (r *RedisClient) writePayment(tx *redis.Multi, ts int64, login, token, txHash string, amount *big.Int) {
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("pending", token), neg(amount))
+	r.hincrWei(tx, r.formatKey("miners", login), withToken("paid", token), amount)
+	r.hincrWei(tx, r.formatKey("finances"), withToken("pending", token), neg(amount))
+	r.hincrWei(tx, r.formatKey("finances"), withToken("paid", token), amount)
+	tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: withToken(join(txHash, login, amount), token)})
+	tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: withToken(join(txHash, amount), token)})
+	tx.ZRem(r.formatKey("payments", "pending"), withToken(join(login, amount), token))
+}
+
+// Payment is sent once submitted, pending once node has it in tx pool.
+// Failed tx was mined but reverted, dropped one was never mined and its nonce was used by another tx.
+// Unresolved payment has its nonce used while tx id is unknown, only operator can tell if it's paid.
+const (
+	PaymentNew        = "new"
+	PaymentSent       = "sent"
+	PaymentPending    = "pending"
+	PaymentConfirmed  = "confirmed"
+	PaymentFailed     = "failed"
+	PaymentDropped    = "dropped"
+	PaymentUnresolved = "unresolved"
+)
+
+// Finished plans are kept for inspection
+const finishedPlanTTL = 30 * 24 * time.Hour
+
+// All payments of a single payout run, persisted before anything is sent
+type PayoutPlan struct {
+	Id       string            `json:"id"`
+	Payments []*PlannedPayment `json:"payments"`
+}
+
+type PlannedPayment struct {
+	Address string   `json:"login"`
+	Token   string   `json:"token"`
+	Amount  *big.Int `json:"amount"`
+	Nonce   uint64   `json:"nonce"`
+	TxHash  string   `json:"tx"`
+	State   string   `json:"state"`
+	// Unix time of last submission and gas price it was signed with
+	SentAt   int64    `json:"sentAt"`
+	GasPrice *big.Int `json:"gasPrice"`
+	// Earlier submissions replaced by TxHash, any of them may still be mined
+	Replaced []string `json:"replaced"`
+}
+
+func (p *PayoutPlan) Done() bool {
+	for _, v := range p.Payments {
+		if v.State == PaymentNew || v.State == PaymentSent || v.State == PaymentPending || v.State == PaymentUnresolved {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PlannedPayment) key() string {
+	return join(p.Amount, p.Nonce, p.TxHash, p.State, p.SentAt, p.GasPrice, strings.Join(p.Replaced, ","))
+}
+
+// Every tx submitted for this payment, the latest first
+func (p *PlannedPayment) TxHashes() []string {
+	var hashes []string
+	if len(p.TxHash) > 0 {
+		hashes = append(hashes, p.TxHash)
+	}
+	for i := len(p.Replaced) - 1; i >= 0; i-- {
+		hashes = append(hashes, p.Replaced[i])
+	}
+	return hashes
+}
+
+// Field of plan hash, a miner has one payment per token
+func (p *PlannedPayment) field() string {
+	return withToken(p.Address, p.Token)
+}
+
+// Locks payouts for the plan and debits all balances at once
+func (r *RedisClient) CreatePayoutPlan(plan *PayoutPlan) error {
+	key := r.formatKey("payments", "lock")
+	result := r.client.SetNX(key, join("plan", plan.Id), 0).Val()
+	if !result {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+
 	tx := r.client.Multi()
 	defer tx.Close()
 
+	ts := util.MakeTimestamp() / 1000
+
 	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		for _, p := range plan.Payments {
+			r.debitBalance(tx, ts, p.Address, p.Token, p.Amount)
+			tx.HSet(r.formatKey("payments", "plan", plan.Id), p.field(), p.key())
+		}
+		tx.Set(r.formatKey("payments", "plan"), plan.Id, 0)
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
+// Returns nil if there is no unfinished payout plan
+func (r *RedisClient) GetPayoutPlan() (*PayoutPlan, error) {
+	id, err := r.client.Get(r.formatKey("payments", "plan")).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cmd := r.client.HGetAllMap(r.formatKey("payments", "plan", id))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPayoutPlan(id, cmd.Val()), nil
+}
+
+func convertPayoutPlan(id string, raw map[string]string) *PayoutPlan {
+	plan := &PayoutPlan{Id: id}
+	for field, v := range raw {
+		// "amount:nonce:txHash:state:sentAt:gasPrice:replacedHashes"
+		fields := strings.Split(v, ":")
+		login, token := splitToken(field)
+		p := &PlannedPayment{Address: login, Token: token, TxHash: fields[2], State: fields[3]}
+		p.Amount, _ = parseWei(fields[0])
+		p.Nonce, _ = strconv.ParseUint(fields[1], 10, 64)
+		if len(fields) > 6 {
+			p.SentAt, _ = strconv.ParseInt(fields[4], 10, 64)
+			if gasPrice, _ := parseWei(fields[5]); gasPrice != nil && gasPrice.Sign() > 0 {
+				p.GasPrice = gasPrice
+			}
+			if len(fields[6]) > 0 {
+				p.Replaced = strings.Split(fields[6], ",")
+			}
+		}
+		plan.Payments = append(plan.Payments, p)
+	}
+	sort.Slice(plan.Payments, func(i, j int) bool {
+		return plan.Payments[i].Nonce < plan.Payments[j].Nonce
+	})
+	return plan
+}
+
+func (r *RedisClient) UpdatePlannedPayment(planId string, p *PlannedPayment) error {
+	return r.client.HSet(r.formatKey("payments", "plan", planId), p.field(), p.key()).Err()
+}
+
+// Logs confirmed payment of a plan, lock stays until the whole plan is finished
+func (r *RedisClient) WritePlannedPayment(planId string, p *PlannedPayment) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
 	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		r.writePayment(tx, ts, p.Address, p.Token, p.TxHash, p.Amount)
+		tx.HSet(r.formatKey("payments", "plan", planId), p.field(), p.key())
+		return nil
+	})
+	return err
+}
+
+// Credits back payment of a plan which was never sent, failed on chain or was dropped
+func (r *RedisClient) FailPlannedPayment(planId string, p *PlannedPayment) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		r.rollbackBalance(tx, p.Address, p.Token, p.Amount)
+		tx.HSet(r.formatKey("payments", "plan", planId), p.field(), p.key())
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) FinishPayoutPlan(planId string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.Expire(r.formatKey("payments", "plan", planId), finishedPlanTTL)
+		tx.Del(r.formatKey("payments", "plan"))
 		tx.Del(r.formatKey("payments", "lock"))
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards TokenRewards) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	_, err := tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
-			tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+		for token, rewards := range roundRewards {
+			total := new(big.Int)
+			for login, amount := range rewards {
+				total.Add(total, amount)
+				r.hincrWei(tx, r.formatKey("miners", login), withToken("immature", token), amount)
+				tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), withToken(login, token), amount.String())
+			}
+			r.hincrWei(tx, r.formatKey("finances"), withToken("immature", token), total)
 		}
-		tx.HIncrBy(r.formatKey("finances"), "immature", total)
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards TokenRewards) error {
+	return r.writeMaturedCredits(block, roundRewards, false)
+}
+
+// Miners were already paid for PPS shares in default token, block reward only covers pool's PPS liability.
+// Other tokens of coinbase are still credited by round shares.
+func (r *RedisClient) WritePPSMaturedBlock(block *BlockData, roundRewards TokenRewards) error {
+	return r.writeMaturedCredits(block, roundRewards, true)
+}
+
+func (r *RedisClient) writeMaturedCredits(block *BlockData, roundRewards TokenRewards, pps bool) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
 	tx, err := r.client.Watch(creditKey)
 	// Must decrement immatures using existing log entry
@@ -485,32 +933,84 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
 		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
-		}
+		r.writeImmatureDebits(tx, immatureCredits.Val())
 		// Increment balances
-		total := int64(0)
-		for login, amount := range roundRewards {
-			total += amount
-			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
-			//tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+		for token, rewards := range roundRewards {
+			total := new(big.Int)
+			for login, amount := range rewards {
+				total.Add(total, amount)
+				// NOTICE: Maybe expire round reward entry in 604800 (a week)?
+				// Default token balance mirrors on-chain one or PPS ledger, other tokens are kept by pool only
+				if token != util.DefaultToken {
+					r.hincrWei(tx, r.formatKey("miners", login), withToken("balance", token), amount)
+				}
+				tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), withToken(login, token), amount.String())
+			}
+			r.hincrWei(tx, r.formatKey("finances"), withToken("balance", token), total)
 		}
 		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "balance", total)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
 		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
 		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
-		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
+		r.hincrWei(tx, r.formatKey("finances"), "totalMined", block.Reward)
+		for token, reward := range block.TokenRewards {
+			r.hincrWei(tx, r.formatKey("finances"), withToken("totalMined", token), reward)
+		}
+		if pps {
+			r.hincrWei(tx, r.formatKey("finances"), "ppsRevenue", block.Reward)
+		}
+		tx.LPush(r.formatKey("rewards"), block.Reward.String())
+		tx.LTrim(r.formatKey("rewards"), 0, maxRewardsLog-1)
 		return nil
 	})
 	return err
 }
 
+// Average reward in Wei of last n matured blocks, nil if there are no matured blocks yet
+func (r *RedisClient) GetAverageReward(n int64) (*big.Int, error) {
+	rows, err := r.client.LRange(r.formatKey("rewards"), 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	total := new(big.Int)
+	for _, v := range rows {
+		reward, ok := new(big.Int).SetString(v, 10)
+		if !ok {
+			return nil, fmt.Errorf("Invalid reward %s in rewards log", v)
+		}
+		total.Add(total, reward)
+	}
+	return total.Div(total, big.NewInt(int64(len(rows)))), nil
+}
+
+func (r *RedisClient) CollectPPSStats() (map[string]interface{}, error) {
+	cmd := r.client.HMGet(r.formatKey("finances"), "ppsLiability", "ppsRevenue")
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	values := make([]*big.Int, 2)
+	for i, v := range cmd.Val() {
+		values[i] = new(big.Int)
+		if v != nil {
+			values[i], _ = parseWei(v.(string))
+		}
+	}
+	return convertPPSStats(values[0], values[1]), nil
+}
+
+func convertPPSStats(liability, revenue *big.Int) map[string]interface{} {
+	stats := make(map[string]interface{})
+	stats["liability"] = liability.String()
+	stats["revenue"] = revenue.String()
+	// Above 1 means pool earned more than it paid out for shares
+	if liability.Sign() > 0 {
+		stats["luck"], _ = new(big.Rat).SetFrac(revenue, liability).Float64()
+	}
+	return stats
+}
+
 func (r *RedisClient) WriteOrphan(block *BlockData) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
 	tx, err := r.client.Watch(creditKey)
@@ -523,21 +1023,27 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
 
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
-
-		// Decrement immature balances
-		totalImmature := int64(0)
-		for login, amountString := range immatureCredits.Val() {
-			amount, _ := strconv.ParseInt(amountString, 10, 64)
-			totalImmature += amount
-			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
-		}
+		r.writeImmatureDebits(tx, immatureCredits.Val())
 		tx.Del(creditKey)
-		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
 		return nil
 	})
 	return err
 }
 
+// Decrements immature balances using credits logged for a block
+func (r *RedisClient) writeImmatureDebits(tx *redis.Multi, credits map[string]string) {
+	totals := make(map[string]*big.Int)
+	for field, amountString := range credits {
+		login, token := splitToken(field)
+		amount, _ := parseWei(amountString)
+		addWei(totals, token, amount)
+		r.hincrWei(tx, r.formatKey("miners", login), withToken("immature", token), neg(amount))
+	}
+	for token, total := range totals {
+		r.hincrWei(tx, r.formatKey("finances"), withToken("immature", token), neg(total))
+	}
+}
+
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
 	tx := r.client.Multi()
 	defer tx.Close()
@@ -553,7 +1059,8 @@ func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
 
 func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 	// Redis 2.8.x returns "ERR source and destination objects are the same"
-	if block.Height != block.RoundHeight {
+	// Solo blocks have no round shares to rename
+	if block.Height != block.RoundHeight && !block.Solo {
 		tx.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
 	}
 	tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
@@ -590,7 +1097,8 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 	} else {
 		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
 		stats["stats"] = convertStringMap(result)
-		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
+		stats["tokens"] = convertTokenBalances(result)
+		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd).Val(), false)
 		stats["payments"] = payments
 		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
 		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
@@ -601,10 +1109,20 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 }
 
 // Try to convert all numeric strings to int64
+// Money fields are in Wei and kept as decimal strings, they don't fit into JS numbers
+var weiFields = map[string]bool{
+	"balance": true, "immature": true, "pending": true, "paid": true,
+	"totalMined": true, "ppsLiability": true, "ppsRevenue": true,
+}
+
 func convertStringMap(m map[string]string) map[string]interface{} {
 	result := make(map[string]interface{})
 	var err error
 	for k, v := range m {
+		if name, _ := splitToken(k); weiFields[name] {
+			result[k] = v
+			continue
+		}
 		result[k], err = strconv.ParseInt(v, 10, 64)
 		if err != nil {
 			result[k] = v
@@ -632,7 +1150,7 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
 			return total, err
 		}
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
+			login := strings.TrimPrefix(row, r.formatKey("hashrate")+":")
 			if _, ok := miners[login]; !ok {
 				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
 				if err != nil {
@@ -677,7 +1195,7 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		})
 		//fmt.Println("current temstamp before", timestamp - 1080)
 		//fmt.Println("current timestamp: %v", timestamp)
-		totalHashrateTemp, _ := convertMinersStats(window/24, cmdsTemp[0].(*redis.ZSliceCmd))
+		totalHashrateTemp, _ := convertMinersStats(window/24, cmdsTemp[0].(*redis.ZSliceCmd).Val())
 		//fmt.Println("current totalHashrateTemp: %v", totalHashrateTemp)
 		//myString := "{timestamp:" + fmt.Sprintf("%v", timestamp) + ", hashrate:" + fmt.Sprintf("%v",totalHashrateTemp) + "}"
 		//hashrateList =  append(hashrateList, myString)
@@ -700,6 +1218,8 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		tx.ZCard(r.formatKey("blocks", "matured"))
 		tx.ZCard(r.formatKey("payments", "all"))
 		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+		tx.HGetAllMap(r.formatKey("finances"))
+		tx.HGetAllMap(r.formatKey("roots"))
 		return nil
 	})
 
@@ -708,20 +1228,35 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	}
 	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd).Val())
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd).Val())
+	roots, _ := cmds[12].(*redis.StringStringMapCmd).Result()
+	rootIndex := convertRootIndex(roots)
+	confirmations, err := r.GetRootConfirmations(blockHashes(immature))
+	if err != nil {
+		return nil, err
+	}
+	setRootConfirmations(immature, rootIndex, confirmations)
+	stats["roots"] = rootIndex
 	stats["immature"] = immature
 	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd).Val())
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd).Val(), true)
 	stats["payments"] = payments
+	finances, _ := cmds[11].(*redis.StringStringMapCmd).Result()
+	stats["tokens"] = convertTokenBalances(finances)
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd).Val())
+	setMinersStats(stats, totalHashrate, miners)
+	return stats, nil
+}
+
+func setMinersStats(stats map[string]interface{}, totalHashrate int64, miners map[string]Miner) {
 	s := make([]Miner, len(miners))
 	i := 0
 	count := 0
@@ -737,7 +1272,6 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	stats["minersTotal"] = len(miners)
 	stats["minersOffline"] = count
 	stats["hashrate"] = totalHashrate
-	return stats, nil
 }
 
 func (r *RedisClient) CollectProfits(login string) (map[string]interface{}, error) {
@@ -752,7 +1286,7 @@ func (r *RedisClient) CollectProfits(login string) (map[string]interface{}, erro
 			tx.ZRangeByScoreWithScores(r.formatKey("tsblocks", "matured"), redis.ZRangeByScore{Min: fmt.Sprint(timestamp), Max: fmt.Sprint(timestamp + 3600)})
 			return nil
 		})
-		total, _ := convertMinerProfit(cmdsTemp[0].(*redis.ZSliceCmd), login)
+		total, _ := convertMinerProfit(cmdsTemp[0].(*redis.ZSliceCmd).Val(), login)
 		value := make(map[string]interface{})
 		value["timestamp"] = fmt.Sprintf("%v", timestamp)
 		value["profit"] = total
@@ -780,14 +1314,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 			tx.ZRangeByScoreWithScores(r.formatKey("hashrate", login), redis.ZRangeByScore{Min: fmt.Sprint(timeTemp), Max: fmt.Sprint(timeTemp + 3600)})
 			return nil
 		})
-		workersTemp := convertWorkersStats(smallWindow, cmdsTemp[0].(*redis.ZSliceCmd))
-		hashrateTemp := int64(0)
-
-		for _, workerTemp := range workersTemp {
-			boundary := smallWindow / 24
-			workerTemp.TotalHR = workerTemp.TotalHR / boundary
-			hashrateTemp += workerTemp.TotalHR
-		}
+		hashrateTemp := hourlyWorkersHashrate(smallWindow, cmdsTemp[0].(*redis.ZSliceCmd).Val())
 		//myString := "timestamp:" + fmt.Sprintf("%v", timeTemp) + ", hashrate:" + fmt.Sprintf("%v",hashrateTemp)
 		//hashrateList = append(hashrateList, myString)
 		value := make(map[string]interface{})
@@ -799,6 +1326,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	cmds, err := tx.Exec(func() error {
 		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
 		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+		tx.HGetAllMap(r.formatKey("reported", login))
 		return nil
 	})
 
@@ -806,12 +1334,70 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		return nil, err
 	}
 
+	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd).Val())
+	reported, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+
+	// Share outcomes per hour, newest first
+	bucket := now - now%shareStatsBucket
+	cmds, err = tx.Exec(func() error {
+		for i := int64(0); i < shareStatsBuckets; i++ {
+			tx.HGetAllMap(r.formatKey("sharestats", login, bucket-i*shareStatsBucket))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		rows[i], _ = cmd.(*redis.StringStringMapCmd).Result()
+	}
+	workerShares, sharesList := convertShareStats(bucket, rows)
+	setWorkersStats(stats, login, now, smallWindow, largeWindow, workers, reported, workerShares)
+	stats["hashrateList"] = hashrateList
+	stats["sharesList"] = sharesList
+	return stats, nil
+}
+
+func hourlyWorkersHashrate(smallWindow int64, rows []redis.Z) int64 {
+	hashrate := int64(0)
+	for _, worker := range convertWorkersStats(smallWindow, rows) {
+		boundary := smallWindow / 24
+		hashrate += worker.TotalHR / boundary
+	}
+	return hashrate
+}
+
+// Sums share outcomes of hourly buckets (newest first) per worker and per bucket
+func convertShareStats(bucket int64, rows []map[string]string) (map[string]*ShareStats, []map[string]interface{}) {
+	workerShares := make(map[string]*ShareStats)
+	sharesList := make([]map[string]interface{}, len(rows))
+	for i, result := range rows {
+		var total ShareStats
+		for field, value := range result {
+			parts := strings.Split(field, ":")
+			n, _ := strconv.ParseInt(value, 10, 64)
+			total.add(parts[len(parts)-1], n)
+			id := strings.Join(parts[:len(parts)-1], ":")
+			if workerShares[id] == nil {
+				workerShares[id] = &ShareStats{}
+			}
+			workerShares[id].add(parts[len(parts)-1], n)
+		}
+		sharesList[i] = map[string]interface{}{
+			"timestamp": fmt.Sprintf("%v", bucket-int64(i)*shareStatsBucket),
+			"shares":    total,
+		}
+	}
+	return workerShares, sharesList
+}
+
+func setWorkersStats(stats map[string]interface{}, login string, now, smallWindow, largeWindow int64, workers map[string]Worker, reported map[string]string, workerShares map[string]*ShareStats) {
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
+	reportedHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
-
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
 		if timeOnline < 600 {
@@ -837,8 +1423,23 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 			online++
 		}
 
+		// Ignore reports of rigs which stopped sending them
+		if v, ok := reported[id]; ok {
+			parts := strings.Split(v, ":")
+			ts, _ := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+			if len(parts) == 3 && ts >= now-smallWindow {
+				worker.ReportedHR, _ = strconv.ParseInt(parts[0], 10, 64)
+				worker.ClientId = parts[1]
+			}
+		}
+
+		if shares, ok := workerShares[id]; ok {
+			worker.Shares = *shares
+		}
+
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
+		reportedHashrate += worker.ReportedHR
 		workers[id] = worker
 	}
 	s := make([]Worker, len(workers))
@@ -855,8 +1456,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
-	stats["hashrateList"] = hashrateList
-	return stats, nil
+	stats["reportedHashrate"] = reportedHashrate
 }
 
 func (r *RedisClient) CollectMinerBlockStats(login string, maxBlocks int64) (map[string]interface{}, error) {
@@ -870,7 +1470,7 @@ func (r *RedisClient) CollectMinerBlockStats(login string, maxBlocks int64) (map
 	if err != nil {
 		return nil, err
 	}
-	_, matured := convertMinerProfit(cmds[0].(*redis.ZSliceCmd), login)
+	_, matured := convertMinerProfit(cmds[0].(*redis.ZSliceCmd).Val(), login)
 	stats["minerBlockList"] = matured
 	stats["minerBlockTotal"] = len(matured)
 	return stats, nil
@@ -892,7 +1492,19 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 	if err != nil {
 		return stats, err
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+	return calcLuckStats(blocks, windows), nil
+}
+
+func calcLuckStats(rows []*BlockData, windows []int) map[string]interface{} {
+	stats := make(map[string]interface{})
+	var blocks []*BlockData
+	for _, block := range rows {
+		// Solo blocks say nothing about pool luck
+		if !block.Solo {
+			blocks = append(blocks, block)
+		}
+	}
 
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
@@ -927,12 +1539,12 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 			break
 		}
 	}
-	return stats, nil
+	return stats
 }
 
-func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
+func convertCandidateResults(raw []redis.Z) []*BlockData {
 	var result []*BlockData
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
 		block := BlockData{}
 		block.Height = int64(v.Score)
@@ -946,15 +1558,21 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
 		block.candidateKey = v.Member.(string)
 		block.Coinbase = fields[6]
+		if len(fields) > 7 {
+			block.ShareSeq, _ = strconv.ParseInt(fields[7], 10, 64)
+		}
+		if len(fields) > 8 {
+			block.Solo, _ = strconv.ParseBool(fields[8])
+		}
 		result = append(result, &block)
 	}
 	return result
 }
 
-func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
+func convertBlockResults(rows ...[]redis.Z) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
-		for _, v := range row.Val() {
+		for _, v := range row {
 			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
 			block := BlockData{}
 			block.Height = int64(v.Score)
@@ -970,9 +1588,12 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 			block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
 			block.RewardString = fields[6]
 			block.ImmatureReward = fields[6]
-			if len(fields) == 8 {
+			if len(fields) >= 8 {
 				block.Coinbase = fields[7]
 			}
+			if len(fields) > 8 {
+				block.Solo, _ = strconv.ParseBool(fields[8])
+			}
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -982,11 +1603,11 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
+func convertWorkersStats(window int64, raw []redis.Z) map[string]Worker {
 	now := util.MakeTimestamp() / 1000
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -1012,12 +1633,12 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+func convertMinersStats(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -1056,12 +1677,12 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
-func convertMinerProfit(raw *redis.ZSliceCmd, login string) (*big.Int, []*BlockData) {
+func convertMinerProfit(raw []redis.Z, login string) (*big.Int, []*BlockData) {
 	blocks := make(map[string]BlockData)
 	var blockList []*BlockData
 	total := big.NewInt(0)
 	count := int64(0)
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		id := parts[3]
 		block := blocks[id]
@@ -1095,16 +1716,16 @@ func (r *RedisClient) GetMills(smallWindow time.Duration) (map[string]Miner, err
 	if err != nil {
 		return nil, err
 	}
-	_, miners := convertMinersStatsById(window, cmds[0].(*redis.ZSliceCmd))
+	_, miners := convertMinersStatsById(window, cmds[0].(*redis.ZSliceCmd).Val())
 	return miners, nil
 }
 
-func convertMinersStatsById(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+func convertMinersStatsById(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[2]
@@ -1143,19 +1764,22 @@ func convertMinersStatsById(window int64, raw *redis.ZSliceCmd) (int64, map[stri
 	return totalHashrate, miners
 }
 
-func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
+// Rows of payments:all have address, token is appended to rows of non-default tokens
+func convertPaymentsResults(raw []redis.Z, withAddress bool) []map[string]interface{} {
 	var result []map[string]interface{}
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		tx := make(map[string]interface{})
 		tx["timestamp"] = int64(v.Score)
 		fields := strings.Split(v.Member.(string), ":")
 		tx["tx"] = fields[0]
-		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
+		if withAddress {
 			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+			fields = fields[1:]
+		}
+		tx["amount"] = fields[1]
+		tx["token"] = util.DefaultToken
+		if len(fields) > 2 {
+			tx["token"] = fields[2]
 		}
 		result = append(result, tx)
 	}
@@ -1,53 +1,64 @@
 package storage
 
 import (
+	"math/big"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
 
 	"gopkg.in/redis.v3"
+
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 var r *RedisClient
 
+// Redis tests are skipped if there is no server to run them against
+var redisAvailable bool
+
 const prefix = "test"
 
 func TestMain(m *testing.M) {
 	r = NewRedisClient(&Config{Endpoint: "127.0.0.1:6379"}, prefix)
-	reset()
+	if _, err := r.Check(); err == nil {
+		redisAvailable = true
+		reset()
+	}
 	c := m.Run()
-	reset()
+	if redisAvailable {
+		reset()
+	}
 	os.Exit(c)
 }
 
 func TestWriteShareCheckExist(t *testing.T) {
-	reset()
+	setup(t)
 
-	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
+	exist, _ := r.WriteShare("x", "x", nil, nil, []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
+	exist, _ = r.WriteShare("x", "x", nil, nil, []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
+	exist, _ = r.WriteShare("x", "x", nil, nil, []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
+	exist, _ = r.WriteShare("z", "x", nil, nil, []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
 	if !exist {
 		t.Error("PoW must exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
+	exist, _ = r.WriteShare("x", "x", nil, nil, []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
 	if exist {
 		t.Error("PoW must not exist")
 	}
 }
 
 func TestGetPayees(t *testing.T) {
-	reset()
+	setup(t)
 
 	n := 256
 	for i := 0; i < n; i++ {
@@ -69,17 +80,17 @@ func TestGetPayees(t *testing.T) {
 }
 
 func TestGetBalance(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.HSet(r.formatKey("miners:x"), "balance", "750")
 
-	v, _ := r.GetBalance("x")
-	if v != 750 {
+	v, _ := r.GetBalance("x", util.DefaultToken)
+	if v.Int64() != 750 {
 		t.Error("Must return balance")
 	}
 
-	v, err := r.GetBalance("z")
-	if v != 0 {
+	v, err := r.GetBalance("z", util.DefaultToken)
+	if v.Sign() != 0 {
 		t.Error("Must return 0 if account does not exist")
 	}
 	if err != nil {
@@ -88,22 +99,22 @@ func TestGetBalance(t *testing.T) {
 }
 
 func TestLockPayouts(t *testing.T) {
-	reset()
+	setup(t)
 
-	r.LockPayouts("x", 1000)
+	r.LockPayouts("x", big.NewInt(1000))
 	v := r.client.Get("test:payments:lock").Val()
 	if v != "x:1000" {
 		t.Errorf("Invalid lock amount: %v", v)
 	}
 
-	err := r.LockPayouts("x", 100)
+	err := r.LockPayouts("x", big.NewInt(100))
 	if err == nil {
 		t.Errorf("Must not overwrite lock")
 	}
 }
 
 func TestUnlockPayouts(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.Set(r.formatKey("payments:lock"), "x:1000", 0)
 
@@ -115,16 +126,16 @@ func TestUnlockPayouts(t *testing.T) {
 }
 
 func TestIsPayoutsLocked(t *testing.T) {
-	reset()
+	setup(t)
 
-	r.LockPayouts("x", 1000)
+	r.LockPayouts("x", big.NewInt(1000))
 	if locked, _ := r.IsPayoutsLocked(); !locked {
 		t.Errorf("Payouts must be locked")
 	}
 }
 
 func TestUpdateBalance(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.HMSetMap(
 		r.formatKey("miners:x"),
@@ -135,8 +146,8 @@ func TestUpdateBalance(t *testing.T) {
 		map[string]string{"paid": "500", "balance": "10000"},
 	)
 
-	amount := int64(250)
-	r.UpdateBalance("x", amount)
+	amount := big.NewInt(250)
+	r.UpdateBalance("x", util.DefaultToken, amount)
 	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
 	if result["pending"] != "250" {
 		t.Error("Must set pending amount")
@@ -166,7 +177,7 @@ func TestUpdateBalance(t *testing.T) {
 }
 
 func TestRollbackBalance(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.HMSetMap(
 		r.formatKey("miners:x"),
@@ -178,8 +189,8 @@ func TestRollbackBalance(t *testing.T) {
 	)
 	r.client.ZAdd(r.formatKey("payments:pending"), redis.Z{Score: 1, Member: "xx"})
 
-	amount := int64(250)
-	r.RollbackBalance("x", amount)
+	amount := big.NewInt(250)
+	r.RollbackBalance("x", util.DefaultToken, amount)
 	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
 	if result["paid"] != "100" {
 		t.Error("Must not touch paid")
@@ -209,7 +220,7 @@ func TestRollbackBalance(t *testing.T) {
 }
 
 func TestWritePayment(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.HMSetMap(
 		r.formatKey("miners:x"),
@@ -220,8 +231,8 @@ func TestWritePayment(t *testing.T) {
 		map[string]string{"paid": "500", "balance": "10000", "pending": "250"},
 	)
 
-	amount := int64(250)
-	r.WritePayment("x", "0x0", amount)
+	amount := big.NewInt(250)
+	r.WritePayment("x", util.DefaultToken, "0x0", amount)
 	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
 	if result["pending"] != "0" {
 		t.Error("Must unset pending amount")
@@ -264,21 +275,21 @@ func TestWritePayment(t *testing.T) {
 }
 
 func TestGetPendingPayments(t *testing.T) {
-	reset()
+	setup(t)
 
 	r.client.HMSetMap(
 		r.formatKey("miners:x"),
 		map[string]string{"paid": "100", "balance": "750", "pending": "250"},
 	)
 
-	amount := int64(1000)
-	r.UpdateBalance("x", amount)
+	amount := big.NewInt(1000)
+	r.UpdateBalance("x", util.DefaultToken, amount)
 	pending := r.GetPendingPayments()
 
 	if len(pending) != 1 {
 		t.Error("Must return pending payment")
 	}
-	if pending[0].Amount != amount {
+	if pending[0].Amount.Cmp(amount) != 0 {
 		t.Error("Must have corrent amount")
 	}
 	if pending[0].Address != "x" {
@@ -290,7 +301,7 @@ func TestGetPendingPayments(t *testing.T) {
 }
 
 func TestCollectLuckStats(t *testing.T) {
-	reset()
+	setup(t)
 
 	members := []redis.Z{
 		redis.Z{Score: 0, Member: "1:0:0x0:0x0:0:100:100:0"},
@@ -321,6 +332,86 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestMigrate(t *testing.T) {
+	setup(t)
+
+	r.client.HMSetMap(
+		r.formatKey("miners:x"),
+		map[string]string{"balance": "750", "paid": "100", "blocksFound": "1"},
+	)
+	r.client.HSet(r.formatKey("credits:immature:10:0x1"), "x", "25")
+	r.client.ZAdd(r.formatKey("payments:x"), redis.Z{Score: 1, Member: "0x0:100"})
+	r.client.Set(r.formatKey("payments:lock"), "x:250", 0)
+
+	if migrated, _ := r.Migrated(); migrated {
+		t.Error("Store written in Shannon must not be migrated")
+	}
+	if err := r.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, _ := r.Migrated(); !migrated {
+		t.Error("Store must be migrated")
+	}
+	// Must not convert twice
+	if err := r.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	if result["balance"] != "750000000000" || result["paid"] != "100000000000" {
+		t.Errorf("Must convert balances to Wei: %v", result)
+	}
+	if result["blocksFound"] != "1" {
+		t.Error("Must not touch counters")
+	}
+	if v := r.client.HGet(r.formatKey("credits:immature:10:0x1"), "x").Val(); v != "25000000000" {
+		t.Errorf("Must convert credits to Wei: %v", v)
+	}
+	if err := r.client.ZRank(r.formatKey("payments:x"), "0x0:100000000000").Err(); err != nil {
+		t.Errorf("Must convert payments to Wei: %v", err)
+	}
+	if v := r.client.Get(r.formatKey("payments:lock")).Val(); v != "x:250000000000" {
+		t.Errorf("Must convert lock amount to Wei: %v", v)
+	}
+}
+
+func TestRootIndex(t *testing.T) {
+	setup(t)
+
+	r.WriteRootBlock(&RootIndex{Height: 10, Hash: "0xa", MinorHeight: 100}, []string{"0xAB"}, 5)
+	r.WriteRootBlock(&RootIndex{Height: 11, Hash: "0xb", MinorHeight: 101}, []string{"0xcd"}, 5)
+	confirmations, err := r.GetRootConfirmations([]string{"0xab", "0xcd", "0xef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmations) != 2 || confirmations["0xab"] != 10 || confirmations["0xcd"] != 11 {
+		t.Errorf("Invalid root confirmations %v", confirmations)
+	}
+
+	if indexed, _ := r.GetIndexedRoot(10); indexed == nil || indexed.Hash != "0xa" || indexed.MinorHeight != 100 {
+		t.Errorf("Invalid indexed root block %v", indexed)
+	}
+
+	r.RewindRootIndex(&RootIndex{Height: 10, Hash: "0xa", MinorHeight: 100})
+	index, _ := r.GetRootIndex()
+	if index == nil || index.Height != 10 || index.Hash != "0xa" || index.MinorHeight != 100 {
+		t.Errorf("Invalid root index %v", index)
+	}
+	if indexed, _ := r.GetIndexedRoot(11); indexed != nil {
+		t.Errorf("Replaced root block must be dropped, got %v", indexed)
+	}
+	if confirmations, _ := r.GetRootConfirmations([]string{"0xcd"}); len(confirmations) != 0 {
+		t.Errorf("Confirmation by replaced root block must be dropped, got %v", confirmations)
+	}
+}
+
+func setup(t *testing.T) {
+	if !redisAvailable {
+		t.Skip("Redis is not available on 127.0.0.1:6379")
+	}
+	reset()
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Position of unlocker in root chain, minor blocks of pool shard are indexed up to it
+type RootIndex struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+	// Highest minor block of pool shard confirmed by indexed root blocks
+	MinorHeight int64 `json:"minorHeight"`
+}
+
+// Number of root blocks confirming minor block included into root block of given height
+func (i *RootIndex) Confirmations(rootHeight int64) int64 {
+	return i.Height - rootHeight + 1
+}
+
+// Indexed chain is kept as "height:hash:minorHeight" members scored by height
+func (i *RootIndex) chainMember() string {
+	return join(i.Height, i.Hash, i.MinorHeight)
+}
+
+func convertRootChain(member string) *RootIndex {
+	fields := strings.Split(member, ":")
+	if len(fields) != 3 {
+		return nil
+	}
+	index := &RootIndex{Hash: fields[1]}
+	index.Height, _ = strconv.ParseInt(fields[0], 10, 64)
+	index.MinorHeight, _ = strconv.ParseInt(fields[2], 10, 64)
+	return index
+}
+
+func convertRootIndex(m map[string]string) *RootIndex {
+	if len(m) == 0 {
+		return nil
+	}
+	index := &RootIndex{Hash: m["hash"]}
+	index.Height, _ = strconv.ParseInt(m["height"], 10, 64)
+	index.MinorHeight, _ = strconv.ParseInt(m["minorHeight"], 10, 64)
+	return index
+}
+
+// Sets root block height and confirmations of blocks known to root index
+func setRootConfirmations(blocks []*BlockData, index *RootIndex, confirmations map[string]int64) {
+	if index == nil {
+		return
+	}
+	for _, block := range blocks {
+		if height, ok := confirmations[strings.ToLower(block.Hash)]; ok {
+			block.RootHeight = height
+			block.RootConfirmations = index.Confirmations(height)
+		}
+	}
+}
+
+func blockHashes(blocks []*BlockData) []string {
+	hashes := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes
+}
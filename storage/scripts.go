@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"gopkg.in/redis.v3"
+)
+
+// Arithmetic on signed decimal strings, money is kept in Wei which doesn't fit HINCRBY's int64
+const bigIntLua = `
+local function cmpabs(a, b)
+	if #a ~= #b then
+		return #a < #b and -1 or 1
+	end
+	if a == b then
+		return 0
+	end
+	return a < b and -1 or 1
+end
+
+local function addabs(a, b)
+	local r, carry = {}, 0
+	local i, j = #a, #b
+	while i > 0 or j > 0 or carry > 0 do
+		local d = carry
+		if i > 0 then
+			d = d + a:byte(i) - 48
+			i = i - 1
+		end
+		if j > 0 then
+			d = d + b:byte(j) - 48
+			j = j - 1
+		end
+		r[#r + 1] = d % 10
+		carry = math.floor(d / 10)
+	end
+	return string.reverse(table.concat(r))
+end
+
+-- Requires a >= b
+local function subabs(a, b)
+	local r, borrow = {}, 0
+	local i, j = #a, #b
+	while i > 0 do
+		local d = a:byte(i) - 48 - borrow
+		if j > 0 then
+			d = d - (b:byte(j) - 48)
+			j = j - 1
+		end
+		if d < 0 then
+			d, borrow = d + 10, 1
+		else
+			borrow = 0
+		end
+		r[#r + 1] = d
+		i = i - 1
+	end
+	local s = string.gsub(string.reverse(table.concat(r)), "^0+", "")
+	if s == "" then
+		return "0"
+	end
+	return s
+end
+
+local function bigadd(a, b)
+	local na, nb = a:sub(1, 1) == "-", b:sub(1, 1) == "-"
+	if na then a = a:sub(2) end
+	if nb then b = b:sub(2) end
+	local s, neg
+	if na == nb then
+		s, neg = addabs(a, b), na
+	elseif cmpabs(a, b) >= 0 then
+		s, neg = subabs(a, b), na
+	else
+		s, neg = subabs(b, a), nb
+	end
+	if neg and s ~= "0" then
+		return "-" .. s
+	end
+	return s
+end
+
+local function hincrbig(key, field, delta)
+	local value = bigadd(redis.call("HGET", key, field) or "0", delta)
+	redis.call("HSET", key, field, value)
+	return value
+end
+`
+
+// HINCRBY for Wei amounts: KEYS: hash, ARGV: field, signed decimal delta
+var incrBigScript = redis.NewScript(bigIntLua + `
+return hincrbig(KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// Writes a share and, if it's a block, the block candidate in a single atomic call.
+// Returns 1 if the same PoW was already submitted, 0 otherwise.
+//
+// KEYS: pow, shares:seq, shares:roundCurrent, shares:log, hashrate, hashrate:login, miners:login,
+// finances, stats, finders, shares:round<height>:<nonce>, blocks:candidates
+// ARGV: height, "nonce:powHash:mixDigest", login, id, diff, ms, ts, expire in ms, balance or "",
+// credit in Wei, share log size, pool share flag, block flag, round difficulty
+var writeShareScript = redis.NewScript(bigIntLua + `
+local height = tonumber(ARGV[1])
+local pow, login, id, diff, ms, ts = ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], ARGV[7]
+local pool, block = ARGV[12] == "1", ARGV[13] == "1"
+
+-- Sweep PoW backlog for previous blocks, we have a few templates back in RAM
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. string.format("%d", height - 8))
+if redis.call("ZADD", KEYS[1], ARGV[1], pow) == 0 then
+	return 1
+end
+
+local seq = 0
+if pool then
+	redis.call("HINCRBY", KEYS[3], login, diff)
+	local logSize = tonumber(ARGV[11])
+	if logSize > 0 then
+		seq = redis.call("INCR", KEYS[2])
+		redis.call("ZADD", KEYS[4], seq, diff .. ":" .. login .. ":" .. seq)
+		redis.call("ZREMRANGEBYRANK", KEYS[4], 0, -(logSize + 1))
+	end
+end
+
+redis.call("ZADD", KEYS[5], ts, diff .. ":" .. login .. ":" .. id .. ":" .. ms)
+redis.call("ZADD", KEYS[6], ts, diff .. ":" .. id .. ":" .. ms)
+redis.call("PEXPIRE", KEYS[6], ARGV[8])
+redis.call("HSET", KEYS[7], "lastShare", ts)
+if ARGV[9] ~= "" then
+	redis.call("HSET", KEYS[7], "balance", ARGV[9])
+end
+if ARGV[10] ~= "0" then
+	hincrbig(KEYS[7], "balance", ARGV[10])
+	hincrbig(KEYS[8], "balance", ARGV[10])
+	hincrbig(KEYS[8], "ppsLiability", ARGV[10])
+end
+
+if not block then
+	if pool then
+		redis.call("HINCRBY", KEYS[9], "roundShares", diff)
+	end
+	return 0
+end
+
+redis.call("ZINCRBY", KEYS[10], 1, login)
+redis.call("HINCRBY", KEYS[7], "blocksFound", 1)
+local candidate
+if pool then
+	redis.call("HSET", KEYS[9], "lastBlockFound", ts)
+	redis.call("HDEL", KEYS[9], "roundShares")
+	redis.call("RENAME", KEYS[3], KEYS[11])
+	-- Summed as decimal strings, Lua numbers lose precision of a large round
+	local total = "0"
+	for _, v in ipairs(redis.call("HVALS", KEYS[11])) do
+		total = bigadd(total, v)
+	end
+	candidate = table.concat({pow, ts, ARGV[14], total, login, seq}, ":")
+else
+	-- Solo block keeps pool round untouched, candidate is paid to the finder only
+	candidate = table.concat({pow, ts, ARGV[14], "0", login, "0", "1"}, ":")
+end
+redis.call("ZADD", KEYS[12], ARGV[1], candidate)
+return 0
+`)
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Round rewards in Wei by token and login
+type TokenRewards map[string]map[string]*big.Int
+
+// Amounts of default token are kept under plain field and member names, so existing data stays valid,
+// other tokens get token name appended
+func withToken(name, token string) string {
+	if len(token) == 0 || token == util.DefaultToken {
+		return name
+	}
+	return join(name, token)
+}
+
+// Reverse of withToken for names without ":" inside, like logins and hash fields
+func splitToken(s string) (string, string) {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, util.DefaultToken
+}
+
+func addWei(m map[string]*big.Int, key string, amount *big.Int) {
+	if m[key] == nil {
+		m[key] = new(big.Int)
+	}
+	m[key].Add(m[key], amount)
+}
+
+// Groups money fields of miner or finances hash by token
+func convertTokenBalances(m map[string]string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for k, v := range m {
+		name, token := splitToken(k)
+		if !weiFields[name] {
+			continue
+		}
+		if result[token] == nil {
+			result[token] = make(map[string]string)
+		}
+		result[token][name] = v
+	}
+	return result
+}
@@ -1,9 +1,11 @@
 package util
 
 import (
+	"fmt"
 	"math/big"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
@@ -14,8 +16,12 @@ import (
 
 const (
 	epochLength        = 30000   // Blocks per epoch
+	tokenBase          = 36      // QuarkChain token name alphabet size
 )
 
+// Native token of QuarkChain, gas and PPS credits are paid in it
+const DefaultToken = "QKC"
+
 var Ether = math.BigPow(10, 18)
 var Shannon = math.BigPow(10, 9)
 
@@ -93,4 +99,51 @@ func String2Big(num string) *big.Int {
 	return n
 }
 
+// Encodes QuarkChain native token name like "QKC" to token id, base 36 as in pyquarkchain
+func TokenIdEncode(name string) (uint64, error) {
+	if len(name) == 0 || len(name) > 12 {
+		return 0, fmt.Errorf("Invalid token name length: %v", name)
+	}
+	charEncode := func(c byte) (uint64, error) {
+		switch {
+		case c >= '0' && c <= '9':
+			return uint64(c - '0'), nil
+		case c >= 'A' && c <= 'Z':
+			return uint64(10 + c - 'A'), nil
+		}
+		return 0, fmt.Errorf("Invalid token name: %v", name)
+	}
+	id, err := charEncode(name[len(name)-1])
+	if err != nil {
+		return 0, err
+	}
+	base := uint64(tokenBase)
+	for i := len(name) - 2; i >= 0; i-- {
+		n, err := charEncode(name[i])
+		if err != nil {
+			return 0, err
+		}
+		id += base * (n + 1)
+		base *= tokenBase
+	}
+	return id, nil
+}
+
 
+
+// Converts full shard id like "0x10001" (chain 1, shard size 1, shard 0) to full shard key "0x00010000"
+func FullShardKey(shardId string) (string, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(shardId, "0x"), 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("Invalid shard id: %v", shardId)
+	}
+	chain, low := id>>16, id&0xffff
+	if low == 0 {
+		return "", fmt.Errorf("Invalid shard id: %v", shardId)
+	}
+	size := uint64(1)
+	for size*2 <= low {
+		size *= 2
+	}
+	return fmt.Sprintf("0x%08x", chain<<16|(low-size)), nil
+}
@@ -0,0 +1,24 @@
+package util
+
+import "testing"
+
+func TestFullShardKey(t *testing.T) {
+	keys := map[string]string{
+		"0x1":     "0x00000000",
+		"0x10001": "0x00010000",
+		"0x10002": "0x00010000",
+		"0x10003": "0x00010001",
+		"0x20005": "0x00020001",
+	}
+	for shardId, expected := range keys {
+		key, err := FullShardKey(shardId)
+		if err != nil || key != expected {
+			t.Errorf("Invalid full shard key of %v: %v, %v", shardId, key, err)
+		}
+	}
+	for _, shardId := range []string{"0x10000", "0x", "zz"} {
+		if _, err := FullShardKey(shardId); err == nil {
+			t.Errorf("Shard id %v must be rejected", shardId)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 import Ember from 'ember';
 
 export function formatBalance(value) {
-	value = value * 0.000000001;
+	value = value * 0.000000000000000001;
 	return value.toFixed(8);
 }
 